@@ -2,19 +2,25 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"smtp-server/config"
+	"smtp-server/db"
+	"smtp-server/smtp"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 	"golang.org/x/crypto/bcrypt"
 )
 
-var rdb = redis.NewClient(&redis.Options{
-	Addr: "localhost:6379",
-})
+var rdb *redis.Client
 
 type User struct {
 	Username string `json:"username"`
@@ -36,6 +42,14 @@ func createUserHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "username, password and email are required", http.StatusBadRequest)
 		return
 	}
+	// Stored the way the SMTP server sees it in the envelope: UTF-8 local
+	// parts in NFC, the domain in ASCII.
+	email, err := smtp.ParseAddress(u.Email)
+	if err != nil {
+		http.Error(w, "invalid email", http.StatusBadRequest)
+		return
+	}
+	u.Email = email
 	key := "user:" + u.Username
 	exists, err := rdb.Exists(ctx, key).Result()
 	if err != nil {
@@ -63,12 +77,47 @@ func createUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	scram, err := smtp.NewSCRAMCredentials(u.Password)
+	if err != nil {
+		http.Error(w, "hash error", 500)
+		return
+	}
+
+	// address:<email> lets the SMTP server find the mailbox for a recipient.
+	addrKey := "address:" + strings.ToLower(u.Email)
+	claimed, err := rdb.SetNX(ctx, addrKey, u.Username, 0).Result()
+	if err != nil {
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if !claimed {
+		// The address may still point at a user that has been deleted.
+		owner, err := rdb.Get(ctx, addrKey).Result()
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		if n, err := rdb.Exists(ctx, "user:"+owner).Result(); err != nil || n == 1 {
+			http.Error(w, "email in use", http.StatusBadRequest)
+			return
+		}
+		if err := rdb.Set(ctx, addrKey, u.Username, 0).Err(); err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	err = rdb.HSet(ctx, key, map[string]interface{}{
-		"password": string(hashedPassword),
-		"email":    u.Email,
+		"password":         string(hashedPassword),
+		"email":            u.Email,
+		"scram_salt":       base64.StdEncoding.EncodeToString(scram.Salt),
+		"scram_iterations": scram.Iterations,
+		"scram_stored_key": base64.StdEncoding.EncodeToString(scram.StoredKey),
+		"scram_server_key": base64.StdEncoding.EncodeToString(scram.ServerKey),
 	}).Err()
 
 	if err != nil {
+		rdb.Del(ctx, addrKey)
 		http.Error(w, "db error", http.StatusInternalServerError)
 		return
 	}
@@ -77,7 +126,37 @@ func createUserHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	c, _ := config.FromCommandLine()
+
+	var err error
+	if rdb, err = db.ConnectRedis(c.RedisURL); err != nil {
+		log.Fatal(err)
+	}
+
 	http.HandleFunc("/create-user", createUserHandler)
-	log.Println("User service running on :9000")
-	http.ListenAndServe(":9000", nil)
+	srv := &http.Server{Addr: c.HTTP.Addr}
+
+	go func() {
+		log.Println("User service running on", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Nothing here can change live; don't let a SIGHUP meant for the
+	// smtp-server end the process.
+	signal.Ignore(syscall.SIGHUP)
+
+	// On SIGTERM, stop accepting and let requests in flight finish.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	<-ctx.Done()
+	stop()
+
+	log.Println("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), c.ShutdownGrace)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Println("Shutdown:", err)
+	}
 }
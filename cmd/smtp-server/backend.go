@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"smtp-server/smtp"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	errTooManyAttempts = &smtp.SMTPError{Code: 454, EnhancedCode: smtp.EnhancedCode{4, 7, 0}, Message: "Too many login attempts"}
+	errAccountLocked   = &smtp.SMTPError{Code: 535, EnhancedCode: smtp.EnhancedCode{5, 7, 8}, Message: "Account temporarily locked"}
+	errQueue           = &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "Queue error"}
+	errLocal           = &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "Local error"}
+	errRelayDenied     = &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Relaying denied"}
+	errUserUnknown     = &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user here"}
+)
+
+// redisBackend authenticates users stored under user:<name> and queues
+// accepted mail on mail_queue for SaveMailWorker. Unauthenticated sessions,
+// which only the inbound MX listener lets through to MAIL, may only send
+// to local domains and to Postmaster.
+type redisBackend struct{}
+
+func (b *redisBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &redisSession{remoteIP: c.RemoteIP()}, nil
+}
+
+type redisSession struct {
+	remoteIP net.IP
+	userName string
+	mailFrom string
+	rcpts    []string
+	// DSN parameters, carried through the queue to notification
+	// generation.
+	ret    smtp.DSNReturn
+	envid  string
+	notify map[string][]smtp.DSNNotify
+	orcpt  map[string]string
+	body   smtp.BodyType
+	utf8   bool
+}
+
+func (s *redisSession) AuthAllowed(username string) error {
+	if !rl.Validate(username, s.remoteIP) {
+		return errTooManyAttempts
+	}
+	if auth.CheckLock(username) {
+		return errAccountLocked
+	}
+
+	return nil
+}
+
+func (s *redisSession) Auth(username, password string) error {
+	dbHashPass, err := rdb.HGet(
+		context.Background(),
+		"user:"+username,
+		"password",
+	).Result()
+
+	if err == redis.Nil {
+		auth.IncreaseFails(username)
+		return smtp.ErrAuthFailed
+	}
+	if err != nil {
+		return errLocal
+	}
+
+	err = bcrypt.CompareHashAndPassword(
+		[]byte(dbHashPass),
+		[]byte(password),
+	)
+	if err != nil {
+		auth.IncreaseFails(username)
+		return smtp.ErrAuthFailed
+	}
+
+	s.userName = username
+	rdb.Del(context.Background(), fmt.Sprintf("auth:fail:user:%s", username))
+	return nil
+}
+
+func (s *redisSession) SCRAMCredentials(username string) (*smtp.SCRAMCredentials, error) {
+	fields, err := rdb.HMGet(
+		context.Background(),
+		"user:"+username,
+		"scram_salt", "scram_iterations", "scram_stored_key", "scram_server_key",
+	).Result()
+	if err != nil {
+		return nil, errLocal
+	}
+
+	var values [4]string
+	for i, f := range fields {
+		v, ok := f.(string)
+		if !ok {
+			// Unknown user, or one created before SCRAM verifiers were
+			// stored. The failure is counted by SCRAMResult at the end of
+			// the exchange.
+			return nil, smtp.ErrAuthFailed
+		}
+		values[i] = v
+	}
+
+	salt, err1 := base64.StdEncoding.DecodeString(values[0])
+	iterations, err2 := strconv.Atoi(values[1])
+	storedKey, err3 := base64.StdEncoding.DecodeString(values[2])
+	serverKey, err4 := base64.StdEncoding.DecodeString(values[3])
+	if err := errors.Join(err1, err2, err3, err4); err != nil {
+		log.Println("Corrupt SCRAM credentials for", username, err)
+		return nil, errLocal
+	}
+
+	return &smtp.SCRAMCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey,
+		ServerKey:  serverKey,
+	}, nil
+}
+
+// loadSCRAMSecret returns the key for the SCRAM salts made up for unknown
+// users, creating it on first use. It lives in Redis so that every process
+// and every restart hands out the same salt for the same name.
+func loadSCRAMSecret(ctx context.Context) ([]byte, error) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	if err := rdb.SetNX(ctx, "scram_secret", base64.StdEncoding.EncodeToString(secret), 0).Err(); err != nil {
+		return nil, err
+	}
+
+	stored, err := rdb.Get(ctx, "scram_secret").Result()
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(stored)
+}
+
+func (s *redisSession) SCRAMResult(username string, ok bool) error {
+	if !ok {
+		auth.IncreaseFails(username)
+		return nil
+	}
+
+	s.userName = username
+	rdb.Del(context.Background(), fmt.Sprintf("auth:fail:user:%s", username))
+	return nil
+}
+
+func (s *redisSession) Mail(from string, opts *smtp.MailOptions) error {
+	s.ret, s.envid = opts.Return, opts.EnvelopeID
+	s.body, s.utf8 = opts.Body, opts.UTF8
+	if s.userName == "" {
+		s.mailFrom = from
+		return nil
+	}
+
+	dbUserEmail, err := rdb.HGet(
+		context.Background(),
+		"user:"+s.userName,
+		"email",
+	).Result()
+	if err == redis.Nil {
+		return smtp.ErrAuthFailed
+	}
+	if err != nil {
+		return errLocal
+	}
+	if dbUserEmail != from {
+		return smtp.ErrAuthFailed
+	}
+
+	s.mailFrom = from
+	return nil
+}
+
+func (s *redisSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if to == smtp.Postmaster {
+		// Accepted from anyone, and delivered to the configured mailbox
+		// whether or not a user owns it yet (see deliverLocal).
+		to = cfg.Load().PostmasterAddress()
+	} else if !isLocalDomain(getDomain(to)) {
+		if s.userName == "" {
+			return errRelayDenied
+		}
+	} else if _, err := lookupLocalUser(context.Background(), to); err != nil {
+		if errors.Is(err, errNoSuchUser) {
+			return errUserUnknown
+		}
+		return errLocal
+	}
+
+	s.rcpts = append(s.rcpts, to)
+	if opts.Notify != nil {
+		if s.notify == nil {
+			s.notify = make(map[string][]smtp.DSNNotify)
+		}
+		s.notify[to] = opts.Notify
+	}
+	if opts.OriginalRecipient != "" {
+		if s.orcpt == nil {
+			s.orcpt = make(map[string]string)
+		}
+		s.orcpt[to] = opts.OriginalRecipientType + ";" + opts.OriginalRecipient
+	}
+	return nil
+}
+
+func (s *redisSession) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	msg, err := newQueuedMessage(s.userName, s.mailFrom, s.rcpts)
+	if err != nil {
+		log.Println(err)
+		return smtp.ErrLocal
+	}
+	msg.Return, msg.EnvelopeID = s.ret, s.envid
+	msg.BodyType, msg.UTF8 = s.body, s.utf8
+	for _, r := range msg.Recipients {
+		r.Notify = s.notify[r.Address]
+		r.OriginalRecipient = s.orcpt[r.Address]
+	}
+
+	if err := queueMessage(msg, string(data)); err != nil {
+		log.Println("Error queueing message:", err)
+		return errQueue
+	}
+
+	return nil
+}
+
+func (s *redisSession) Reset() {
+	s.mailFrom = ""
+	s.rcpts = nil
+	s.ret, s.envid = "", ""
+	s.notify, s.orcpt = nil, nil
+	s.body, s.utf8 = "", false
+}
+
+func (s *redisSession) Logout() error {
+	return nil
+}
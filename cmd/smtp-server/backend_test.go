@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"smtp-server/config"
+	"smtp-server/smtp"
+)
+
+// ─────────────────────────────────────────────
+// Recipients
+// ─────────────────────────────────────────────
+
+func TestRcpt_PostmasterRoutedToMailbox(t *testing.T) {
+	c := config.Default()
+	useConfig(t, c)
+
+	for _, tc := range []struct {
+		postmaster, want string
+	}{
+		{"", "postmaster@myserver.local"},
+		{"hostmaster@myserver.local", "hostmaster@myserver.local"},
+	} {
+		c.Postmaster = tc.postmaster
+		// Not logged in, as on the MX listener.
+		s := &redisSession{}
+		opts := &smtp.RcptOptions{Notify: []smtp.DSNNotify{smtp.DSNNotifyNever}}
+		if err := s.Rcpt(smtp.Postmaster, opts); err != nil {
+			t.Errorf("%q: Postmaster refused: %v", tc.postmaster, err)
+			continue
+		}
+		if !slices.Equal(s.rcpts, []string{tc.want}) || s.notify[tc.want] == nil {
+			t.Errorf("%q: recipients %q, NOTIFY %v; want %s", tc.postmaster, s.rcpts, s.notify, tc.want)
+		}
+	}
+}
+
+func TestMX_PostmasterAccepted(t *testing.T) {
+	c := config.Default()
+	c.SMTP.MXGreetingDelay = 0
+	useConfig(t, c)
+	r, conn := startSMTP(t, newMXServer(c, newServer(c)))
+
+	for _, cmd := range []string{"EHLO client.example.com", "MAIL FROM:<alice@example.org>", "RCPT TO:<postmaster>"} {
+		conn.Write([]byte(cmd + "\r\n"))
+		if reply := readSMTPReply(t, r); !strings.HasPrefix(reply[len(reply)-1], "250") {
+			t.Fatalf("%s: got %q", cmd, reply)
+		}
+	}
+}
+
+func TestDeliverTo_PostmasterWithoutOwner(t *testing.T) {
+	ctx := useRedis(t)
+
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 10)
+	c := config.Default()
+	c.Postmaster = "pm-" + suffix + "@myserver.local"
+	useConfig(t, c)
+
+	msg := &QueuedMessage{ID: time.Now().UnixNano(), From: "alice@example.org", QueuedAt: time.Now()}
+	mailbox := "mailbox:" + c.Postmaster + ":" + msg.IDString()
+	t.Cleanup(func() { rdb.Del(ctx, mailbox) })
+
+	if _, err := deliverTo(msg, c.Postmaster, "Subject: hi\r\n\r\nhi\r\n"); err != nil {
+		t.Fatalf("postmaster mail refused: %v", err)
+	}
+	stored, err := rdb.HGetAll(ctx, mailbox).Result()
+	if err != nil || stored["to"] != c.Postmaster || stored["from"] != "alice@example.org" {
+		t.Errorf("postmaster mail not stored: %q, %v", stored, err)
+	}
+
+	// Anyone else without a mailbox still bounces.
+	if _, err := deliverTo(msg, "nobody-"+suffix+"@myserver.local", "x"); !errors.Is(err, errUserUnknown) {
+		t.Errorf("unknown local user: got %v, want %v", err, errUserUnknown)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"smtp-server/config"
+	"smtp-server/smtp"
+	"sync/atomic"
+	"syscall"
+)
+
+var (
+	// cfg is the configuration in effect. The settings SIGHUP can change
+	// are read through it; the others are copied into package variables
+	// at startup by applyConfig.
+	cfg atomic.Pointer[config.Config]
+	// certs serves the TLS certificate, nil if TLS is off.
+	certs *smtp.CertReloader
+	// servers are the running listeners, whose message limits SIGHUP
+	// can change.
+	servers []*smtp.Server
+)
+
+// applyConfig sets the package variables that only change on restart.
+func applyConfig(c *config.Config) {
+	Hostname = c.Hostname
+	ShutdownGrace = c.ShutdownGrace
+	DeliveryWorkers = c.Delivery.Workers
+	RetrySchedule = c.Delivery.RetrySchedule
+	MaxRetries = c.Delivery.MaxRetries
+	MaxQueueAge = c.Delivery.MaxQueueAge
+	DelayWarning = c.Delivery.DelayWarning
+	TLSPolicies = tlsPolicies(c.Delivery.TLSPolicies)
+	cfg.Store(c)
+}
+
+// reloadWorker reloads the configuration each time SIGHUP arrives.
+func reloadWorker(ctx context.Context, flags *config.Flags) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			reloadConfig(flags)
+		}
+	}
+}
+
+// reloadConfig applies the reloadable settings of a fresh load. A
+// configuration that does not validate is ignored as a whole.
+func reloadConfig(flags *config.Flags) {
+	next, err := flags.Load()
+	if err != nil {
+		log.Println("Config reload failed, keeping the current settings:", err)
+		return
+	}
+
+	c, restart := cfg.Load().Reload(next)
+	if certs != nil {
+		if err := certs.SetFiles(c.SMTP.TLS.Cert, c.SMTP.TLS.Key); err != nil {
+			log.Println("Config reload failed, keeping the current settings:", err)
+			return
+		}
+	}
+	for _, srv := range servers {
+		srv.SetMessageLimits(c.SMTP.MaxRecipients, c.SMTP.MaxMessageSize)
+	}
+	rl.SetLimits(c.Auth.IPLimit, c.Auth.UserLimit, c.Auth.Window)
+	auth.SetLimits(c.Auth.MaxFails, c.Auth.Lockout)
+	cfg.Store(c)
+
+	log.Println("configuration reloaded")
+	if restart {
+		log.Printf("Only %s were reloaded, other changes need a restart", config.Reloadable)
+	}
+}
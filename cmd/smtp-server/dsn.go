@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"smtp-server/smtp"
+)
+
+// DelayWarning is how long a message may wait in the retry queue before
+// its sender is told it is delayed. Zero disables the warnings.
+var DelayWarning time.Duration
+
+// DSN actions, RFC 3464 section 2.3.3.
+const (
+	dsnFailed    = "failed"
+	dsnDelayed   = "delayed"
+	dsnDelivered = "delivered"
+	// dsnRelayed is reported for NOTIFY=SUCCESS on remote delivery, since
+	// we do not pass the request on to the next server.
+	dsnRelayed = "relayed"
+)
+
+// dsnRecipient is the per-recipient part of a delivery status
+// notification.
+type dsnRecipient struct {
+	Address string
+	Action  string
+	// Status is an RFC 3463 enhanced status code.
+	Status string
+	// Diagnostic is the remote reply, if there was one.
+	Diagnostic string
+	// OriginalRecipient is the ORCPT parameter, as "type;address".
+	OriginalRecipient string
+}
+
+// recipientStatus describes the outcome of a delivery to r that ended
+// with err.
+func recipientStatus(r *Recipient, action string, err error) dsnRecipient {
+	d := dsnRecipient{Address: r.Address, Action: action, OriginalRecipient: r.OriginalRecipient}
+
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		d.Diagnostic = fmt.Sprintf("%d %s", smtpErr.Code, smtpErr.Message)
+		if smtpErr.EnhancedCode != smtp.NoEnhancedCode {
+			c := smtpErr.EnhancedCode
+			d.Status = fmt.Sprintf("%d.%d.%d", c[0], c[1], c[2])
+		}
+	}
+
+	switch action {
+	case dsnFailed:
+		if !strings.HasPrefix(d.Status, "5") {
+			if smtp.IsPermanent(err) {
+				d.Status = "5.0.0"
+			} else {
+				// We kept getting temporary errors until we gave up.
+				d.Status = "5.4.7"
+			}
+		}
+	case dsnDelayed:
+		if !strings.HasPrefix(d.Status, "4") {
+			d.Status = "4.0.0"
+		}
+	case dsnDelivered, dsnRelayed:
+		d.Status = "2.0.0"
+	}
+
+	return d
+}
+
+// sendDSN queues a delivery status notification about msg, whose content
+// is body, for its sender. Messages with a null reverse-path, which
+// includes every DSN we send ourselves, never get one (RFC 5321 section
+// 4.5.5).
+func sendDSN(msg *QueuedMessage, body string, rcpts []dsnRecipient) {
+	if msg.From == "" || len(rcpts) == 0 {
+		return
+	}
+
+	report, err := buildDSN(msg, body, rcpts)
+	if err != nil {
+		log.Println("Error building DSN:", err)
+		return
+	}
+
+	dsn, err := newQueuedMessage("", "", []string{msg.From})
+	if err == nil {
+		// A notification about an internationalised message goes out as
+		// one itself.
+		dsn.UTF8 = msg.UTF8
+		if !smtp.IsASCII(report) {
+			dsn.BodyType = smtp.Body8BitMIME
+		}
+		err = queueMessage(dsn, report)
+	}
+	if err != nil {
+		log.Println("Error queueing DSN:", err)
+	}
+}
+
+// buildDSN renders a multipart/report message (RFC 3462) with a
+// human-readable explanation, the message/delivery-status part and the
+// original message. For an SMTPUTF8 message the parts get their RFC 6533
+// counterparts, which may hold UTF-8.
+func buildDSN(msg *QueuedMessage, data string, rcpts []dsnRecipient) (string, error) {
+	reportType, statusType, messageType, headersType :=
+		"delivery-status", "message/delivery-status", "message/rfc822", "text/rfc822-headers"
+	if msg.UTF8 {
+		reportType, statusType, messageType, headersType =
+			"global-delivery-status", "message/global-delivery-status", "message/global", "message/global-headers"
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	subject := "Undelivered Mail Returned to Sender"
+	switch rcpts[0].Action {
+	case dsnDelayed:
+		subject = "Delayed Mail (still being retried)"
+	case dsnDelivered, dsnRelayed:
+		subject = "Successful Mail Delivery Report"
+	}
+
+	// Human-readable part.
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"text/plain; charset=utf-8"},
+		"Content-Description": {"Notification"},
+	})
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(part, "This is the mail system at host %s.\r\n\r\n", Hostname)
+	for _, r := range rcpts {
+		switch r.Action {
+		case dsnFailed:
+			fmt.Fprintf(part, "Your message could not be delivered to <%s>.\r\n", r.Address)
+		case dsnDelayed:
+			fmt.Fprintf(part, "Your message to <%s> has not been delivered yet. Delivery will\r\n", r.Address)
+			fmt.Fprintf(part, "be retried until %s.\r\n", retryUntil(msg).Format(time.RFC1123Z))
+		case dsnDelivered:
+			fmt.Fprintf(part, "Your message was delivered to <%s>.\r\n", r.Address)
+		case dsnRelayed:
+			fmt.Fprintf(part, "Your message was relayed to <%s>. The receiving server may\r\n", r.Address)
+			fmt.Fprint(part, "not send any further notification.\r\n")
+		}
+		if r.Diagnostic != "" {
+			fmt.Fprintf(part, "The remote server said: %s\r\n", r.Diagnostic)
+		}
+		fmt.Fprint(part, "\r\n")
+	}
+
+	// Machine-readable part.
+	part, err = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {statusType},
+		"Content-Description": {"Delivery report"},
+	})
+	if err != nil {
+		return "", err
+	}
+	if msg.EnvelopeID != "" {
+		fmt.Fprintf(part, "Original-Envelope-Id: %s\r\n", smtp.EncodeXtext(msg.EnvelopeID))
+	}
+	fmt.Fprintf(part, "Reporting-MTA: dns; %s\r\n", Hostname)
+	fmt.Fprintf(part, "Arrival-Date: %s\r\n", msg.QueuedAt.Format(time.RFC1123Z))
+	for _, r := range rcpts {
+		fmt.Fprint(part, "\r\n")
+		if r.OriginalRecipient != "" {
+			fmt.Fprintf(part, "Original-Recipient: %s\r\n", r.OriginalRecipient)
+		}
+		fmt.Fprintf(part, "Final-Recipient: %s; %s\r\n", addressType(r.Address), r.Address)
+		fmt.Fprintf(part, "Action: %s\r\n", r.Action)
+		fmt.Fprintf(part, "Status: %s\r\n", r.Status)
+		if r.Diagnostic != "" {
+			fmt.Fprintf(part, "Diagnostic-Code: smtp; %s\r\n", r.Diagnostic)
+		}
+		fmt.Fprintf(part, "Last-Attempt-Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+		if r.Action == dsnDelayed {
+			fmt.Fprintf(part, "Will-Retry-Until: %s\r\n", retryUntil(msg).Format(time.RFC1123Z))
+		}
+	}
+
+	// The original message, or only its header if the sender asked for
+	// RET=HDRS. Notifications other than failures never carry the body.
+	header := textproto.MIMEHeader{
+		"Content-Type":        {messageType},
+		"Content-Description": {"Undelivered Message"},
+	}
+	if rcpts[0].Action != dsnFailed || msg.Return == smtp.DSNReturnHeaders {
+		header = textproto.MIMEHeader{
+			"Content-Type":        {headersType},
+			"Content-Description": {"Message Headers"},
+		}
+		data = smtp.HeaderSection(data)
+	}
+	part, err = mw.CreatePart(header)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(part, data)
+
+	if err := mw.Close(); err != nil {
+		return "", err
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", Hostname)
+	fmt.Fprintf(&out, "To: <%s>\r\n", msg.From)
+	fmt.Fprintf(&out, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&out, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&out, "Message-ID: <dsn.%s@%s>\r\n", msg.IDString(), Hostname)
+	fmt.Fprint(&out, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprint(&out, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&out, "Content-Type: multipart/report; report-type=%s;\r\n\tboundary=\"%s\"\r\n", reportType, mw.Boundary())
+	fmt.Fprint(&out, "\r\n")
+	out.Write(body.Bytes())
+
+	return out.String(), nil
+}
+
+// addressType is the address type of a recipient field: "utf-8" for an
+// address that needs it (RFC 6533 section 3), "rfc822" otherwise.
+func addressType(address string) string {
+	if smtp.IsASCII(address) {
+		return "rfc822"
+	}
+	return "utf-8"
+}
+
+// retryUntil is when the retry queue gives up on msg.
+func retryUntil(msg *QueuedMessage) time.Time {
+	return msg.QueuedAt.Add(MaxQueueAge)
+}
+
+// shouldWarnDelay reports whether msg has waited long enough for its
+// sender to be told, and has not been warned already.
+func shouldWarnDelay(msg *QueuedMessage) bool {
+	return DelayWarning > 0 && !msg.DelayWarned && time.Since(msg.QueuedAt) >= DelayWarning
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"smtp-server/smtp"
+)
+
+// dsnParts parses a DSN built by buildDSN and returns its report-type and
+// the Content-Type and body of each part.
+func dsnParts(t *testing.T, dsn string) (string, []string, []string) {
+	t.Helper()
+	m, err := mail.ReadMessage(strings.NewReader(dsn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" {
+		t.Fatalf("Content-Type %q: %v", m.Header.Get("Content-Type"), err)
+	}
+
+	var types, bodies []string
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(p)
+		types = append(types, p.Header.Get("Content-Type"))
+		bodies = append(bodies, string(b))
+	}
+	if len(types) != 3 {
+		t.Fatalf("expected three parts, got %q", types)
+	}
+	return params["report-type"], types, bodies
+}
+
+// ─────────────────────────────────────────────
+// Delivery status notifications
+// ─────────────────────────────────────────────
+
+const dsnOriginal = "Subject: hello\r\nFrom: alice@example.com\r\n\r\nthe body\r\n"
+
+func TestRecipientStatus(t *testing.T) {
+	cases := []struct {
+		action string
+		err    error
+		want   string
+	}{
+		{dsnFailed, &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "no such user"}, "5.1.1"},
+		{dsnFailed, &smtp.SMTPError{Code: 554, Message: "no"}, "5.0.0"},
+		{dsnFailed, &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 4, 1}, Message: "try later"}, "5.4.7"},
+		{dsnFailed, errors.New("connection refused"), "5.4.7"},
+		{dsnDelayed, &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 4, 1}, Message: "try later"}, "4.4.1"},
+		{dsnDelayed, errors.New("connection refused"), "4.0.0"},
+		{dsnDelivered, nil, "2.0.0"},
+		{dsnRelayed, nil, "2.0.0"},
+	}
+
+	r := &Recipient{Address: "bob@example.net", OriginalRecipient: "rfc822;bob@example.net"}
+	for _, tc := range cases {
+		d := recipientStatus(r, tc.action, tc.err)
+		if d.Status != tc.want || d.Action != tc.action || d.OriginalRecipient != r.OriginalRecipient {
+			t.Errorf("%s after %v: got %+v, want status %s", tc.action, tc.err, d, tc.want)
+		}
+	}
+}
+
+func TestBuildDSN_Return(t *testing.T) {
+	failed := []dsnRecipient{{Address: "bob@example.net", Action: dsnFailed, Status: "5.1.1"}}
+	delayed := []dsnRecipient{{Address: "bob@example.net", Action: dsnDelayed, Status: "4.0.0"}}
+	cases := []struct {
+		name     string
+		ret      smtp.DSNReturn
+		rcpts    []dsnRecipient
+		wantType string
+		wantBody string
+	}{
+		{"failed RET=FULL", smtp.DSNReturnFull, failed, "message/rfc822", dsnOriginal},
+		{"failed without RET", "", failed, "message/rfc822", dsnOriginal},
+		{"failed RET=HDRS", smtp.DSNReturnHeaders, failed, "text/rfc822-headers", "Subject: hello\r\nFrom: alice@example.com\r\n\r\n"},
+		// Only failures return the content.
+		{"delayed RET=FULL", smtp.DSNReturnFull, delayed, "text/rfc822-headers", "Subject: hello\r\nFrom: alice@example.com\r\n\r\n"},
+	}
+
+	for _, tc := range cases {
+		msg := &QueuedMessage{ID: 1, From: "alice@example.com", Return: tc.ret, QueuedAt: time.Now()}
+		dsn, err := buildDSN(msg, dsnOriginal, tc.rcpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reportType, types, bodies := dsnParts(t, dsn)
+		if reportType != "delivery-status" || types[1] != "message/delivery-status" {
+			t.Errorf("%s: report-type %q, status part %q", tc.name, reportType, types[1])
+		}
+		if types[2] != tc.wantType || bodies[2] != tc.wantBody {
+			t.Errorf("%s: last part %q %q, want %q %q", tc.name, types[2], bodies[2], tc.wantType, tc.wantBody)
+		}
+	}
+}
+
+func TestBuildDSN_SMTPUTF8(t *testing.T) {
+	for _, tc := range []struct {
+		action, wantType string
+	}{
+		{dsnFailed, "message/global"},
+		{dsnDelayed, "message/global-headers"},
+	} {
+		msg := &QueuedMessage{ID: 1, From: "jörg@example.com", UTF8: true, QueuedAt: time.Now()}
+		rcpts := []dsnRecipient{{Address: "δοκιμή@example.net", Action: tc.action, Status: "5.1.1"}}
+		dsn, err := buildDSN(msg, dsnOriginal, rcpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reportType, types, bodies := dsnParts(t, dsn)
+		if reportType != "global-delivery-status" || types[1] != "message/global-delivery-status" || types[2] != tc.wantType {
+			t.Errorf("%s: report-type %q, parts %q", tc.action, reportType, types)
+		}
+		if !strings.Contains(bodies[1], "Final-Recipient: utf-8; δοκιμή@example.net\r\n") {
+			t.Errorf("%s: UTF-8 recipient not reported as such:\n%s", tc.action, bodies[1])
+		}
+	}
+}
+
+func TestSendDSN_NullReversePath(t *testing.T) {
+	// Without Redis, queueing the DSN would panic; a bounce must not get
+	// that far.
+	msg := &QueuedMessage{ID: 1, From: "", QueuedAt: time.Now()}
+	sendDSN(msg, dsnOriginal, []dsnRecipient{{Address: "bob@example.net", Action: dsnFailed, Status: "5.1.1"}})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// errNoSuchUser is a permanent failure: no local user owns the address.
+var errNoSuchUser = errors.New("no such local user")
+
+// addressKey is the index entry mapping a local address to its user. The
+// http-server writes it when a user is created.
+func addressKey(address string) string {
+	return "address:" + strings.ToLower(address)
+}
+
+// lookupLocalUser resolves a local address to the user that owns it.
+func lookupLocalUser(ctx context.Context, address string) (string, error) {
+	username, err := rdb.Get(ctx, addressKey(address)).Result()
+	if err == redis.Nil {
+		return "", errNoSuchUser
+	}
+
+	return username, err
+}
+
+// isPostmaster reports whether address is the configured postmaster
+// mailbox.
+func isPostmaster(address string) bool {
+	return strings.EqualFold(address, cfg.Load().PostmasterAddress())
+}
+
+// deliverLocal stores msg in the mailbox of the user owning to. The entry
+// is keyed on the message ID, so delivering the same message again
+// overwrites it instead of adding a copy. Mail for the postmaster is never
+// refused: while no user owns that address it is kept in a mailbox named
+// after the address itself.
+func deliverLocal(msg *QueuedMessage, to, body string) error {
+	ctx := context.Background()
+
+	username, err := lookupLocalUser(ctx, to)
+	if errors.Is(err, errNoSuchUser) && isPostmaster(to) {
+		username, err = strings.ToLower(to), nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return rdb.HSet(
+		ctx,
+		fmt.Sprintf("mailbox:%s:%s", username, msg.IDString()),
+		map[string]any{
+			"id":     msg.IDString(),
+			"sender": msg.Username,
+			"from":   msg.From,
+			"to":     to,
+			"data":   body,
+			"time":   msg.QueuedAt.Unix(),
+		},
+	).Err()
+}
+
+// indexUserAddresses fills the address index for users created before it
+// existed. Existing entries are left alone.
+func indexUserAddresses(ctx context.Context) error {
+	iter := rdb.Scan(ctx, 0, "user:*", 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		email, err := rdb.HGet(ctx, key, "email").Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		username := strings.TrimPrefix(key, "user:")
+		if err := rdb.SetNX(ctx, addressKey(email), username, 0).Err(); err != nil {
+			return err
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	log.Println("address index up to date")
+	return nil
+}
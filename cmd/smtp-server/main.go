@@ -1,431 +1,371 @@
 package main
 
 import (
-	"bufio"
 	"context"
-	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"net"
+	"os"
+	"os/signal"
+	"smtp-server/config"
 	"smtp-server/db"
 	"smtp-server/middleware"
-	"sort"
+	"smtp-server/smtp"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 	"github.com/sony/sonyflake/v2"
-	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/idna"
 )
 
 var (
-	IDGen        *sonyflake.Sonyflake
-	rl           *middleware.RateLimiter
-	auth         *middleware.Auth
-	LocalDomains = map[string]bool{
-		"myserver.local": true, // placeholder
-	}
-	rdb *redis.Client
-)
-
-const startEpochInMilli = 1767225600000
-
-type SessionState int
-
-const (
-	StateInit SessionState = iota
-	StateHelo
-	StateMail
-	StateRcpt
-	StateData
+	IDGen *sonyflake.Sonyflake
+	rl    *middleware.RateLimiter
+	auth  *middleware.Auth
+	rdb   *redis.Client
+	// Hostname is announced in our greeting and in outbound EHLO.
+	Hostname string
 )
 
-type SMTPSession struct {
-	conn          net.Conn
-	state         SessionState
-	userName      string
-	mailFrom      string
-	rcpt          string
-	data          string
-	authenticated bool
-}
-
 func main() {
+	c, flags := config.FromCommandLine()
+	applyConfig(c)
+
 	var err error
-	rdb, err = db.ConnectRedis()
+	rdb, err = db.ConnectRedis(c.RedisURL)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	IDGen, err = sonyflake.New(sonyflake.Settings{
-		StartTime: time.UnixMilli(startEpochInMilli),
+		StartTime: c.IDEpoch,
 	})
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	rl = middleware.NewRateLimit(rdb, 20, 5, 5*time.Minute)
-	auth = middleware.SetupAuth(rdb, 5, 10*time.Second)
-
-	lis, err := net.Listen("tcp", ":8000")
-	if err != nil {
+	if err := indexUserAddresses(context.Background()); err != nil {
 		log.Fatal(err)
 	}
-	defer lis.Close()
-
-	log.Println("listening on port 8000")
-
-	go SaveMailWorker()
-
-	for {
-		conn, err := lis.Accept()
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-		go handleConnection(conn)
-	}
-}
 
-func handleConnection(conn net.Conn) {
-	defer conn.Close()
+	rl = middleware.NewRateLimit(rdb, c.Auth.IPLimit, c.Auth.UserLimit, c.Auth.Window)
+	auth = middleware.SetupAuth(rdb, c.Auth.MaxFails, c.Auth.Lockout)
 
-	session := &SMTPSession{
-		conn: conn,
+	s := newServer(c)
+	s.Addr = c.SMTP.Addr
+	s.EnableAuth("SCRAM-SHA-256", smtp.SCRAMSHA256Mechanism)
+	if s.SCRAMSecret, err = loadSCRAMSecret(context.Background()); err != nil {
+		log.Fatal(err)
 	}
 
-	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
-
-	writeAndFlush(writer, "220 SimpleSMTP ready\r\n")
-
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			log.Println(err)
-			conn.Write([]byte("451 server error"))
-			return
+	if c.SMTP.TLS.Enabled() {
+		if certs, err = smtp.NewCertReloader(c.SMTP.TLS.Cert, c.SMTP.TLS.Key); err != nil {
+			log.Fatal(err)
 		}
+		s.TLSConfig = certs.TLSConfig()
+		s.AuthRequiresTLS = !c.SMTP.TLS.AllowInsecureAuth
+		s.TLSAddr = c.SMTP.TLS.Addr
 
-		line = strings.TrimSpace(line)
-		log.Println(line)
-
-		switch {
-		case strings.HasPrefix(line, "AUTH LOGIN"):
-			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
-			ip := net.ParseIP(host)
+		go serve("implicit TLS", s.TLSAddr, s.ListenAndServeTLS)
+	}
 
-			writeAndFlush(writer, "334 VXNlcm5hbWU6\r\n")
+	if Resolver, err = newResolver(c.Delivery.DNSServers); err != nil {
+		log.Fatal(err)
+	}
 
-			userLine, _ := reader.ReadString('\n')
-			userNameBytes, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(userLine))
-			username := string(userNameBytes)
+	servers = []*smtp.Server{s}
 
-			if !rl.Validate(username, net.IP(ip)) {
-				writeAndFlush(writer, "454 Too many login attempts\r\n")
-				continue
-			}
-			if auth.CheckLock(username) {
-				writeAndFlush(writer, "535 Account temporarily locked\r\n")
-				continue
-			}
+	if c.SMTP.MXAddr != "" {
+		mx := newMXServer(c, s)
+		servers = append(servers, mx)
 
-			writeAndFlush(writer, "334 UGFzc3dvcmQ6\r\n")
+		go serve("inbound mail", mx.Addr, mx.ListenAndServe)
+	}
 
-			passLine, _ := reader.ReadString('\n')
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
-			passwordBytes, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(passLine))
-			password := string(passwordBytes)
+	id, err := IDGen.NextID()
+	if err != nil {
+		log.Fatal(err)
+	}
+	workerID = fmt.Sprint(id)
+	if err := beat(); err != nil {
+		log.Fatal(err)
+	}
 
-			dbHashPass, err := rdb.HGet(
-				context.Background(),
-				"user:"+username,
-				"password",
-			).Result()
+	go heartbeatWorker()
+	go reaperWorker(ctx)
+	var workers sync.WaitGroup
+	for n := range DeliveryWorkers {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			SaveMailWorker(ctx, n)
+		}()
+	}
+	go schedulerWorker(ctx)
+	go reloadWorker(ctx, flags)
 
-			if err == redis.Nil {
-				auth.IncreaseFails(username)
-				writeAndFlush(writer, "535 Authentication failed\r\n")
-				continue
-			}
-			if err != nil {
-				writeAndFlush(writer, "451 Local error\r\n")
-				continue
-			}
+	go serve("submission", s.Addr, s.ListenAndServe)
 
-			err = bcrypt.CompareHashAndPassword(
-				[]byte(dbHashPass),
-				[]byte(password),
-			)
-			if err != nil {
-				auth.IncreaseFails(username)
-				writeAndFlush(writer, "535 Authentication failed\r\n")
-			} else {
-				session.authenticated = true
-				session.state = StateInit
-				session.userName = username
-				rdb.Del(context.Background(), fmt.Sprintf("auth:fail:user:%s", username))
-				writeAndFlush(writer, "235 Authentication successful\r\n")
-			}
+	<-ctx.Done()
+	stop()
+	shutdown(servers, &workers)
+}
 
-		case strings.HasPrefix(line, "HELO"):
-			if !session.validateSession(StateInit, writer) {
-				continue
-			}
-			session.state = StateHelo
-			writeAndFlush(writer, "250 Hello\r\n")
+// newMXServer returns the inbound MX listener, which takes mail from other
+// MTAs without AUTH and feeds it into the same queue as submissions. It
+// offers no AUTH at all: a session logged in there could relay, and
+// nothing would stop passwords going over port 25 in plaintext.
+func newMXServer(c *config.Config, submission *smtp.Server) *smtp.Server {
+	mx := newServer(c)
+	mx.Addr = c.SMTP.MXAddr
+	mx.GreetingDelay = c.SMTP.MXGreetingDelay
+	mx.AuthRequired = false
+	mx.AuthRequiresTLS = submission.AuthRequiresTLS
+	mx.DisableAuth()
+	mx.TLSConfig = submission.TLSConfig
+
+	return mx
+}
 
-		case strings.HasPrefix(line, "MAIL FROM:"):
-			if !session.validateSession(StateHelo, writer) {
-				continue
-			}
+// newServer returns a server for redisBackend with the session limits of
+// c applied.
+func newServer(c *config.Config) *smtp.Server {
+	srv := smtp.NewServer(&redisBackend{})
+	srv.Domain = c.Hostname
+	srv.Timeouts = smtp.Timeouts(c.SMTP.Timeouts)
+	srv.MaxLineLength = c.SMTP.MaxLineLength
+	srv.MaxErrors = c.SMTP.MaxErrors
+	srv.MaxConns = c.SMTP.MaxConns
+	srv.MaxConnsPerIP = c.SMTP.MaxConnsPerIP
+	srv.SetMessageLimits(c.SMTP.MaxRecipients, c.SMTP.MaxMessageSize)
+	srv.Extensions = smtp.Extensions(c.SMTP.Extensions)
+
+	return srv
+}
 
-			dbUserEmail, err := rdb.HGet(
-				context.Background(),
-				"user:"+session.userName,
-				"email",
-			).Result()
-			if err == redis.Nil || session.userName == "" {
-				writeAndFlush(writer, "535 Authentication failed\r\n")
-				continue
-			}
-			if err != nil {
-				writeAndFlush(writer, "451 Local error\r\n")
-				continue
-			}
-			addr := strings.TrimSpace(line[len("MAIL FROM:"):])
-			addr = strings.Trim(addr, "<>")
-			if dbUserEmail != addr {
-				writeAndFlush(writer, "535 Authentication failed\r\n")
-				continue
-			}
+// getDomain returns the domain of an address, lower-cased and with any
+// internationalised labels in their ASCII form, as DNS and the settings
+// know it. The last "@" is used, since a quoted local part may contain
+// one.
+func getDomain(email string) string {
+	i := strings.LastIndexByte(email, '@')
+	if i < 0 {
+		return ""
+	}
 
-			session.state = StateMail
-			session.mailFrom = line
-			writeAndFlush(writer, "250 OK\r\n")
+	domain := email[i+1:]
+	if ascii, err := idna.Lookup.ToASCII(domain); err == nil {
+		domain = ascii
+	}
+	return strings.ToLower(domain)
+}
 
-		case strings.HasPrefix(line, "RCPT TO:"):
-			if !session.validateSession(StateMail, writer) {
-				continue
-			}
-			session.state = StateRcpt
-			session.rcpt = line
-			writeAndFlush(writer, "250 OK\r\n")
+func isLocalDomain(domain string) bool {
+	return cfg.Load().IsLocalDomain(domain)
+}
 
-		case line == "DATA":
-			if !session.validateSession(StateRcpt, writer) {
-				continue
-			}
-			session.state = StateData
+// SaveMailWorker is delivery worker n. It delivers messages from
+// mail_queue until ctx is done, and a message stays on the worker's
+// processing list until every recipient has been delivered, retried or
+// dropped, so a crash never loses it.
+func SaveMailWorker(ctx context.Context, n int) {
+	processing := processingKey(workerID, n)
+	for ctx.Err() == nil {
+		raw, err := rdb.BLMove(context.Background(), "mail_queue", processing, "RIGHT", "LEFT", fetchTimeout).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			log.Println("Error fetching from queue:", err)
+			continue
+		}
 
-			writeAndFlush(writer, "354 End data with <CR><LF>.<CR><LF>\r\n")
+		msg, err := decodeMessage(raw)
+		if err != nil {
+			log.Println("Error decoding queued message:", err)
+			rdb.RPush(context.Background(), "failed_mail_queue", raw)
+			ack(processing, raw)
+			continue
+		}
 
-			var body strings.Builder
-			for {
-				dl, _ := reader.ReadString('\n')
-				dl = strings.TrimSpace(dl)
+		deliverMsg(msg)
+		ack(processing, raw)
+	}
+}
 
-				if dl == "." {
-					break
-				}
-				body.WriteString(dl + "\n")
-			}
-			session.data = body.String()
+// deliverMsg attempts every recipient of msg that is due. Each delivery is
+// recorded as it happens and recipients already recorded are skipped, so a
+// message handed out twice reaches nobody twice. Recipients that failed
+// for now are retried later with the message; the sender hears about
+// failures, delays and, if asked, successes through DSNs.
+func deliverMsg(msg *QueuedMessage) {
+	ctx := context.Background()
+	key := "mail:" + msg.IDString()
+	now := time.Now()
+
+	body, bodyErr := msg.loadBody(ctx)
+
+	var failed, delayed, succeeded []dsnRecipient
+	delivered, dropped := 0, 0
+	for _, r := range msg.Pending() {
+		if r.NextAttempt.After(now) {
+			continue
+		}
+		if done, _ := rdb.HExists(ctx, key, "delivered:"+r.Address).Result(); done {
+			r.Status = rcptDelivered
+			continue
+		}
 
-			fmt.Println("MAIL:", session.mailFrom)
-			fmt.Println("RCPT:", session.rcpt)
-			fmt.Println("DATA:", session.data)
+		var res *sendResult
+		err := bodyErr
+		if err == nil {
+			res, err = deliverTo(msg, r.Address, body)
+		}
 
-			id, err := IDGen.NextID()
-			if err != nil {
-				log.Println(err)
-				writeAndFlush(writer, "451 Local error in processing\r\n")
-				continue
+		var d *deferral
+		if errors.As(err, &d) {
+			r.NextAttempt = now.Add(d.wait)
+			continue
+		}
+		if err == nil {
+			r.Status = rcptDelivered
+			fields := map[string]any{"delivered:" + r.Address: time.Now().Unix()}
+			action := dsnDelivered
+			if res != nil {
+				r.record(res.Reply, nil)
+				fields["response:"+r.Address] = res.Reply
+				fields["tls:"+r.Address] = res.tlsSummary()
+				action = dsnRelayed
+			} else {
+				r.record("", nil)
 			}
-
-			msg := map[string]any{
-				"id":       id,
-				"username": session.userName,
-				"from":     session.mailFrom,
-				"to":       session.rcpt,
-				"data":     session.data,
-				"time":     time.Now().Unix(),
-				"retry":    0,
+			if err := rdb.HSet(ctx, key, fields).Err(); err != nil {
+				log.Println("Error saving delivery record:", err)
 			}
-
-			msgJSON, err := json.Marshal(msg)
-			if err != nil {
-				writeAndFlush(writer, "451 Local error in processing\r\n")
-				continue
+			delivered++
+			if r.wants(smtp.DSNNotifySuccess) {
+				succeeded = append(succeeded, recipientStatus(r, action, nil))
 			}
+			continue
+		}
 
-			err = rdb.LPush(context.Background(), "mail_queue", msgJSON).Err()
-			if err != nil {
-				writeAndFlush(writer, "451 Queue error\r\n")
-				continue
+		r.record("", err)
+		if !smtp.IsPermanent(err) && retryLater(msg, r) {
+			if r.wants(smtp.DSNNotifyDelay) {
+				delayed = append(delayed, recipientStatus(r, dsnDelayed, err))
 			}
-
-			writeAndFlush(writer, "250 Message accepted\r\n")
-
-			session.Reset()
-
-		case line == "RSET":
-			session.Reset()
-			writeAndFlush(writer, "250 OK\r\n")
 			continue
-
-		case line == "QUIT":
-			writeAndFlush(writer, "221 Bye\r\n")
-			return
-
-		default:
-			writeAndFlush(writer, "500 Syntax error, command unrecognized\r\n")
+		}
+		log.Printf("Dropping mail %s to %s. Last error: %s", msg.IDString(), r.Address, err)
+		r.Status = rcptFailed
+		dropped++
+		if r.wants(smtp.DSNNotifyFailure) {
+			failed = append(failed, recipientStatus(r, dsnFailed, err))
 		}
 	}
-}
 
-func (s *SMTPSession) validateSession(valid SessionState, w *bufio.Writer) bool {
-	if !s.authenticated {
-		writeAndFlush(w, "530 Authentication required\r\n")
-		return false
+	if len(delayed) > 0 && shouldWarnDelay(msg) {
+		sendDSN(msg, body, delayed)
+		msg.DelayWarned = true
 	}
-
-	if s.state != valid {
-		writeAndFlush(w, "503 Bad sequence of commands\r\n")
-		return false
+	sendDSN(msg, body, failed)
+	sendDSN(msg, body, succeeded)
+	if dropped > 0 {
+		parkFailed(msg)
+	}
+	if delivered > 0 {
+		saveDeliveryRecord(msg, body)
 	}
 
-	return true
-}
-
-func (s *SMTPSession) Reset() {
-	s.mailFrom = ""
-	s.rcpt = ""
-	s.data = ""
-	s.state = StateHelo
+	if len(msg.Pending()) > 0 {
+		scheduleRetry(msg)
+	} else {
+		releaseBody(msg)
+	}
 }
 
-func getDomain(email string) string {
-	parts := strings.Split(email, "@")
-	if len(parts) != 2 {
-		return ""
+// saveDeliveryRecord fills in the envelope part of the mail:<id> record.
+func saveDeliveryRecord(msg *QueuedMessage, body string) {
+	to := make([]string, 0, len(msg.Recipients))
+	retries := 0
+	for _, r := range msg.Recipients {
+		to = append(to, r.Address)
+		retries = max(retries, r.failedAttempts())
 	}
 
-	return parts[1]
-}
-
-func lookupMX(domain string) (string, error) {
-	mxRecords, err := net.LookupMX(domain)
+	err := rdb.HSet(context.Background(), "mail:"+msg.IDString(), map[string]any{
+		"from":     msg.From,
+		"to":       strings.Join(to, ","),
+		"username": msg.Username,
+		"data":     body,
+		"time":     time.Now().Unix(),
+		"retry":    retries,
+	}).Err()
 	if err != nil {
-		return "", err
+		log.Println("Error saving delivery record:", err)
 	}
-
-	sort.Slice(mxRecords, func(i, j int) bool {
-		return mxRecords[i].Pref < mxRecords[j].Pref
-	})
-
-	return strings.TrimSuffix(mxRecords[0].Host, "."), nil
 }
 
-func SaveMailWorker() {
-	for {
-		res, err := rdb.BRPop(context.Background(), 0, "mail_queue").Result()
-		if err != nil {
-			log.Println("Error fetching from queue:", err)
-			continue
-		}
-
-		var msg map[string]any
-		err = json.Unmarshal([]byte(res[1]), &msg)
-		if err != nil {
-			log.Println("Error unmarshaling message:", err)
-			continue
-		}
-
-		to := msg["to"].(string)
-		domain := getDomain(to)
-
-		if LocalDomains[domain] {
-			err := rdb.HSet(
-				context.Background(),
-				fmt.Sprintf("mailbox:%s:%s", msg["username"], msg["id"]),
-				msg,
-			).Err()
-			if err != nil {
-				go AddToRetry(msg, err, 3)
-				continue
-			}
-		} else {
-			mxHost, err := lookupMX(domain)
-			if err != nil {
-				go AddToRetry(msg, err, 2)
-				continue
-			}
+// releaseBody removes the stored content of a message that has no pending
+// recipients left. A message with failed recipients keeps it for a while
+// alongside its failed_mail_queue entry.
+func releaseBody(msg *QueuedMessage) {
+	if msg.BodyKey == "" {
+		return
+	}
 
-			log.Println("Message saved successfully:", msg["id"])
-			err = SendSMTP(mxHost+":25", msg["from"].(string), msg["to"].(string), msg["data"].(string))
-			if err != nil {
-				go AddToRetry(msg, err, 3)
-				continue
-			}
+	ctx := context.Background()
+	for _, r := range msg.Recipients {
+		if r.Status == rcptFailed {
+			rdb.Expire(ctx, msg.BodyKey, failedBodyTTL)
+			return
 		}
+	}
+	rdb.Del(ctx, msg.BodyKey)
+}
 
-		err = rdb.HSet(
-			context.Background(),
-			"mail:"+fmt.Sprint(msg["id"]),
-			map[string]any{
-				"from":     msg["from"],
-				"to":       msg["to"],
-				"username": msg["username"],
-				"data":     msg["data"],
-				"time":     time.Now().Unix(),
-				"retry":    msg["retry"],
-			},
-		).Err()
-		if err != nil {
-			go AddToRetry(msg, err, 1)
+// deliverTo delivers body to a single recipient of msg. For remote
+// recipients it also returns what the receiving MTA answered and how the
+// connection was secured. A *deferral means the recipient was not tried.
+func deliverTo(msg *QueuedMessage, to, body string) (*sendResult, error) {
+	domain := getDomain(to)
+
+	if isLocalDomain(domain) {
+		err := deliverLocal(msg, to, body)
+		if errors.Is(err, errNoSuchUser) {
+			// The user went away after RCPT was accepted; retrying won't help.
+			return nil, errUserUnknown
 		}
+		return nil, err
 	}
-}
 
-func AddToRetry(msg map[string]any, err error, nextAttempt int) {
-	msg["error"] = err.Error()
-	tries := 0
-	if r, ok := msg["retry"].(float64); ok {
-		tries = int(r)
+	// Slow or throttling providers get their share of the workers and no
+	// more; anything over their limits waits on the retry queue.
+	domain = strings.ToLower(domain)
+	if !slots.acquire(domain) {
+		return nil, &deferral{throttleDelay}
 	}
-	tries++
-	if tries > 5 {
-		log.Printf("Droping mail. Last error: %s", err.Error())
-		msgJSON, _ := json.Marshal(msg)
-		rdb.RPush(context.Background(), "failed_mail_queue", msgJSON)
-		return
+	defer slots.release(domain)
+	if ok, wait := allowDomainSend(domain); !ok {
+		return nil, &deferral{wait}
 	}
-	msg["retry"] = tries
-	msgJSON, _ := json.Marshal(msg)
-	rdb.ZAdd(context.Background(), "mail_retry_queue", redis.Z{
-		Score:  float64(nextAttempt),
-		Member: msgJSON,
-	})
-	log.Println("Retrying message save:", err)
-}
 
-func schedulerWorker() {
-	now := time.Now().Unix()
-
-	msgs, _ := rdb.ZRangeByScore(context.Background(), "mail_retry_queue", &redis.ZRangeBy{
-		Min: "0",
-		Max: fmt.Sprint(now),
-	}).Result()
+	mxHosts, err := lookupMX(domain)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, m := range msgs {
-		rdb.LPush(context.Background(), "mail_queue", m)
-		rdb.ZRem(context.Background(), "mail_retry_queue", m)
+	res, err := sendToMX(mxHosts, msg.From, to, body, &smtp.MailOptions{Body: msg.BodyType, UTF8: msg.UTF8})
+	if err != nil {
+		return nil, err
 	}
-}
 
-func writeAndFlush(w *bufio.Writer, msg string) {
-	w.WriteString(msg)
-	w.Flush()
+	log.Println("Message delivered:", msg.IDString(), to, res.Reply)
+	return res, nil
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"smtp-server/config"
+	"smtp-server/smtp"
+)
+
+// startSMTP serves srv on a local port and returns a connection to it,
+// past the greeting.
+func startSMTP(t *testing.T, srv *smtp.Server) (*bufio.Reader, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	conn, err := net.DialTimeout("tcp", l.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	r := bufio.NewReader(conn)
+	if reply := readSMTPReply(t, r); !strings.HasPrefix(reply[0], "220") {
+		t.Fatalf("unexpected greeting %q", reply)
+	}
+	return r, conn
+}
+
+// readSMTPReply reads every line of one reply.
+func readSMTPReply(t *testing.T, r *bufio.Reader) []string {
+	t.Helper()
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimRight(line, "\r\n"))
+		if len(line) < 4 || line[3] != '-' {
+			return lines
+		}
+	}
+}
+
+// ─────────────────────────────────────────────
+// Inbound MX listener
+// ─────────────────────────────────────────────
+
+func TestMX_NoAuthOffered(t *testing.T) {
+	c := config.Default()
+	c.SMTP.MXGreetingDelay = 0
+	submission := newServer(c)
+	submission.AuthRequiresTLS = true
+	mx := newMXServer(c, submission)
+	if !mx.AuthRequiresTLS {
+		t.Error("MX listener does not require TLS for AUTH")
+	}
+
+	r, conn := startSMTP(t, mx)
+	conn.Write([]byte("EHLO client.example.com\r\n"))
+	if exts := strings.Join(readSMTPReply(t, r), "\n"); strings.Contains(exts, "AUTH") {
+		t.Errorf("AUTH offered on the MX listener: %q", exts)
+	}
+	conn.Write([]byte("AUTH PLAIN AGFsaWNlAHNlY3JldA==\r\n"))
+	if reply := readSMTPReply(t, r); !strings.HasPrefix(reply[0], "502") {
+		t.Errorf("AUTH answered %q, want 502", reply)
+	}
+}
+
+// ─────────────────────────────────────────────
+// Message limits
+// ─────────────────────────────────────────────
+
+func TestNewServer_MessageLimits(t *testing.T) {
+	c := config.Default()
+	c.SMTP.MaxRecipients = 7
+	c.SMTP.MaxMessageSize = 1000
+	srv := newServer(c)
+	if srv.MaxRecipients != 7 || srv.MaxMessageBytes != 1000 {
+		t.Errorf("limits not applied: %d recipients, %d bytes", srv.MaxRecipients, srv.MaxMessageBytes)
+	}
+}
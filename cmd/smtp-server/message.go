@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"smtp-server/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// queueSchemaVersion is written into every queued message. Bump it when
+// the format changes and teach decodeMessage to upgrade the old one, so
+// entries still in flight survive the upgrade. The map-shaped
+// legacyMessage counts as version 1, but was written without a version
+// field and so decodes as 0.
+const queueSchemaVersion = 2
+
+// RecipientStatus is where delivery to one recipient stands.
+type RecipientStatus string
+
+const (
+	rcptPending   RecipientStatus = "pending"
+	rcptDelivered RecipientStatus = "delivered"
+	rcptFailed    RecipientStatus = "failed"
+)
+
+// QueuedMessage is the entry on mail_queue, mail_retry_queue and
+// failed_mail_queue. The body is stored once under BodyKey, so the entry
+// stays small however often it is retried.
+type QueuedMessage struct {
+	Version  int    `json:"v"`
+	ID       int64  `json:"id"`
+	Username string `json:"username,omitempty"`
+	// From is the reverse-path; empty for bounces.
+	From       string       `json:"from"`
+	Recipients []*Recipient `json:"recipients"`
+	BodyKey    string       `json:"body_key,omitempty"`
+	// Body holds the content inline for entries upgraded from before
+	// BodyKey existed.
+	Body string `json:"body,omitempty"`
+	// DSN parameters from MAIL FROM.
+	Return     smtp.DSNReturn `json:"ret,omitempty"`
+	EnvelopeID string         `json:"envid,omitempty"`
+	// BodyType is the BODY parameter from MAIL FROM, so 8-bit and binary
+	// content is relayed as such.
+	BodyType smtp.BodyType `json:"body_type,omitempty"`
+	// UTF8 records the SMTPUTF8 parameter, which the next hop has to
+	// support unless the message turns out not to need it.
+	UTF8        bool      `json:"smtputf8,omitempty"`
+	QueuedAt    time.Time `json:"queued_at"`
+	DelayWarned bool      `json:"delay_warned,omitempty"`
+}
+
+// Recipient is one forward-path of a queued message and the history of
+// delivering to it.
+type Recipient struct {
+	Address string          `json:"address"`
+	Status  RecipientStatus `json:"status"`
+	// DSN parameters from RCPT TO. OriginalRecipient is "type;address".
+	Notify            []smtp.DSNNotify `json:"notify,omitempty"`
+	OriginalRecipient string           `json:"orcpt,omitempty"`
+	// NextAttempt is when the recipient is due; zero means now.
+	NextAttempt time.Time `json:"next_attempt"`
+	Attempts    []Attempt `json:"attempts,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// Attempt records one delivery attempt to a recipient.
+type Attempt struct {
+	Time  time.Time `json:"time"`
+	Reply string    `json:"reply,omitempty"`
+	Error string    `json:"error,omitempty"`
+}
+
+// newQueuedMessage starts a message for the given envelope, with every
+// recipient pending.
+func newQueuedMessage(username, from string, to []string) (*QueuedMessage, error) {
+	id, err := IDGen.NextID()
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &QueuedMessage{
+		Version:  queueSchemaVersion,
+		ID:       id,
+		Username: username,
+		From:     from,
+		BodyKey:  "mail_body:" + strconv.FormatInt(id, 10),
+		QueuedAt: time.Now(),
+	}
+	for _, addr := range to {
+		msg.Recipients = append(msg.Recipients, &Recipient{Address: addr, Status: rcptPending})
+	}
+
+	return msg, nil
+}
+
+// IDString is the message ID as used in Redis keys.
+func (m *QueuedMessage) IDString() string {
+	return strconv.FormatInt(m.ID, 10)
+}
+
+// Pending returns the recipients still to be delivered.
+func (m *QueuedMessage) Pending() []*Recipient {
+	var pending []*Recipient
+	for _, r := range m.Recipients {
+		if r.Status == rcptPending {
+			pending = append(pending, r)
+		}
+	}
+	return pending
+}
+
+// loadBody returns the message content.
+func (m *QueuedMessage) loadBody(ctx context.Context) (string, error) {
+	if m.BodyKey == "" {
+		return m.Body, nil
+	}
+
+	body, err := rdb.Get(ctx, m.BodyKey).Result()
+	if err == redis.Nil {
+		return "", errBodyMissing
+	}
+	return body, err
+}
+
+// failedAttempts counts the attempts that did not deliver.
+func (r *Recipient) failedAttempts() int {
+	n := 0
+	for _, a := range r.Attempts {
+		if a.Error != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// record adds an attempt that ended with reply or err.
+func (r *Recipient) record(reply string, err error) {
+	a := Attempt{Time: time.Now(), Reply: reply}
+	if err != nil {
+		a.Error = err.Error()
+		r.LastError = a.Error
+	}
+	r.Attempts = append(r.Attempts, a)
+}
+
+// wants reports whether the sender asked to hear about cond for r. Without
+// NOTIFY, failures and delays are reported (RFC 3461 section 4.1).
+func (r *Recipient) wants(cond smtp.DSNNotify) bool {
+	if r.Notify == nil {
+		return cond == smtp.DSNNotifyFailure || cond == smtp.DSNNotifyDelay
+	}
+	return slices.Contains(r.Notify, cond)
+}
+
+// errBodyMissing means the stored content of a queued message is gone,
+// which no retry can fix.
+var errBodyMissing = &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 3, 0}, Message: "Message content lost"}
+
+// legacyMessage is the map-shaped entry written before queue entries had
+// a schema version: one message per recipient copy, body inline and a
+// single retry counter.
+type legacyMessage struct {
+	ID       int64               `json:"id"`
+	Username string              `json:"username"`
+	From     string              `json:"from"`
+	To       json.RawMessage     `json:"to"`
+	Data     string              `json:"data"`
+	Time     int64               `json:"time"`
+	Retry    int                 `json:"retry"`
+	Error    string              `json:"error"`
+	Warned   bool                `json:"warned"`
+	Ret      string              `json:"ret"`
+	EnvID    string              `json:"envid"`
+	Notify   map[string][]string `json:"notify"`
+	Orcpt    map[string]string   `json:"orcpt"`
+}
+
+// decodeMessage parses a queue entry of any schema version this build
+// knows.
+func decodeMessage(raw string) (*QueuedMessage, error) {
+	var probe struct {
+		Version int `json:"v"`
+	}
+	if err := json.Unmarshal([]byte(raw), &probe); err != nil {
+		return nil, err
+	}
+
+	var msg *QueuedMessage
+	switch probe.Version {
+	case 0:
+		var old legacyMessage
+		if err := json.Unmarshal([]byte(raw), &old); err != nil {
+			return nil, err
+		}
+		var err error
+		if msg, err = upgradeLegacy(&old); err != nil {
+			return nil, err
+		}
+	case queueSchemaVersion:
+		msg = new(QueuedMessage)
+		if err := json.Unmarshal([]byte(raw), msg); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown queue schema version %d", probe.Version)
+	}
+
+	if msg.ID == 0 || len(msg.Recipients) == 0 {
+		return nil, errors.New("queue entry without ID or recipients")
+	}
+	for _, r := range msg.Recipients {
+		if r == nil || r.Address == "" {
+			return nil, errors.New("queue entry with empty recipient")
+		}
+	}
+
+	return msg, nil
+}
+
+func upgradeLegacy(old *legacyMessage) (*QueuedMessage, error) {
+	var to []string
+	if len(old.To) > 0 && old.To[0] == '"' {
+		var single string
+		if err := json.Unmarshal(old.To, &single); err != nil {
+			return nil, err
+		}
+		to = []string{single}
+	} else if err := json.Unmarshal(old.To, &to); err != nil {
+		return nil, err
+	}
+
+	from, err := legacyPath(old.From, "MAIL FROM:")
+	if err != nil {
+		return nil, fmt.Errorf("legacy reverse-path %q: %w", old.From, err)
+	}
+
+	msg := &QueuedMessage{
+		Version:     queueSchemaVersion,
+		ID:          old.ID,
+		Username:    old.Username,
+		From:        from,
+		Body:        old.Data,
+		Return:      smtp.DSNReturn(old.Ret),
+		EnvelopeID:  old.EnvID,
+		QueuedAt:    time.Unix(old.Time, 0),
+		DelayWarned: old.Warned,
+	}
+	lastErr := old.Error
+	if lastErr == "" && old.Retry > 0 {
+		lastErr = "unknown error"
+	}
+	for _, raw := range to {
+		addr, err := legacyPath(raw, "RCPT TO:")
+		if err == nil && addr == "" {
+			err = errors.New("null path")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("legacy recipient %q: %w", raw, err)
+		}
+		r := &Recipient{
+			Address:           addr,
+			Status:            rcptPending,
+			OriginalRecipient: old.Orcpt[raw],
+			LastError:         lastErr,
+		}
+		for _, n := range old.Notify[raw] {
+			r.Notify = append(r.Notify, smtp.DSNNotify(n))
+		}
+		for range old.Retry {
+			r.Attempts = append(r.Attempts, Attempt{Error: lastErr})
+		}
+		msg.Recipients = append(msg.Recipients, r)
+	}
+
+	return msg, nil
+}
+
+// legacyPath recovers the mailbox from a path in a legacy entry. The first
+// queue stored whole command lines, such as "MAIL FROM:<a@example.com>",
+// later ones the bare address; both come out as smtp.ParseAddress returns
+// them. A null path is returned as "".
+func legacyPath(path, command string) (string, error) {
+	path = strings.TrimSpace(path)
+	if len(path) >= len(command) && strings.EqualFold(path[:len(command)], command) {
+		path = strings.TrimSpace(path[len(command):])
+	}
+	if strings.HasPrefix(path, "<") {
+		end := strings.IndexByte(path, '>')
+		if end < 0 {
+			return "", errors.New("unterminated path")
+		}
+		path = path[1:end]
+	}
+	if path == "" {
+		return "", nil
+	}
+
+	return smtp.ParseAddress(path)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"smtp-server/smtp"
+)
+
+// ─────────────────────────────────────────────
+// Queue entries
+// ─────────────────────────────────────────────
+
+func TestDecodeMessage_RoundTrip(t *testing.T) {
+	queued := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	msg := &QueuedMessage{
+		Version:    queueSchemaVersion,
+		ID:         42,
+		Username:   "alice",
+		From:       "alice@example.com",
+		BodyKey:    "mail_body:42",
+		Return:     smtp.DSNReturnHeaders,
+		EnvelopeID: "env-1",
+		BodyType:   smtp.Body8BitMIME,
+		UTF8:       true,
+		QueuedAt:   queued,
+		Recipients: []*Recipient{{
+			Address:           "bob@example.net",
+			Status:            rcptPending,
+			Notify:            []smtp.DSNNotify{smtp.DSNNotifySuccess},
+			OriginalRecipient: "rfc822;bob@example.net",
+			NextAttempt:       queued.Add(time.Minute),
+			Attempts:          []Attempt{{Time: queued, Error: "421 busy"}},
+			LastError:         "421 busy",
+		}},
+	}
+
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeMessage(string(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, msg) {
+		t.Errorf("got %+v, want %+v", got, msg)
+	}
+}
+
+func TestDecodeMessage_LegacySingleRecipient(t *testing.T) {
+	// As the first queue wrote it: the MAIL and RCPT command lines as they
+	// came in, and the body with bare LF line endings.
+	got, err := decodeMessage(`{"data":"Subject: hi\n\nhi\n","from":"MAIL FROM:<alice@example.com>","id":7,"retry":0,"time":1700000000,"to":"RCPT TO:<bob@example.net>","username":"alice"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Version != queueSchemaVersion || got.ID != 7 || got.Username != "alice" || got.From != "alice@example.com" {
+		t.Errorf("envelope not carried over: %+v", got)
+	}
+	if got.BodyKey != "" || got.Body != "Subject: hi\n\nhi\n" {
+		t.Errorf("body not kept inline: key %q, body %q", got.BodyKey, got.Body)
+	}
+	if !got.QueuedAt.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("QueuedAt = %v", got.QueuedAt)
+	}
+	if len(got.Recipients) != 1 {
+		t.Fatalf("recipients = %+v", got.Recipients)
+	}
+	r := got.Recipients[0]
+	if r.Address != "bob@example.net" || r.Status != rcptPending || len(r.Attempts) != 0 || r.LastError != "" {
+		t.Errorf("recipient = %+v", r)
+	}
+}
+
+func TestDecodeMessage_LegacyRecipientList(t *testing.T) {
+	got, err := decodeMessage(`{
+		"id": 8,
+		"from": "mail from: <alice@example.com>",
+		"to": ["RCPT TO:<bob@example.net>", "carol@example.org"],
+		"data": "x",
+		"time": 1700000000,
+		"retry": 2,
+		"warned": true,
+		"ret": "HDRS",
+		"envid": "env-2",
+		"notify": {"RCPT TO:<bob@example.net>": ["SUCCESS", "FAILURE"]},
+		"orcpt": {"carol@example.org": "rfc822;carol@example.org"}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.From != "alice@example.com" {
+		t.Errorf("From = %q", got.From)
+	}
+	if got.Return != smtp.DSNReturnHeaders || got.EnvelopeID != "env-2" || !got.DelayWarned {
+		t.Errorf("DSN fields not carried over: %+v", got)
+	}
+	if len(got.Recipients) != 2 {
+		t.Fatalf("recipients = %+v", got.Recipients)
+	}
+	bob, carol := got.Recipients[0], got.Recipients[1]
+	if bob.Address != "bob@example.net" || carol.Address != "carol@example.org" {
+		t.Errorf("addresses = %q, %q", bob.Address, carol.Address)
+	}
+	if want := []smtp.DSNNotify{smtp.DSNNotifySuccess, smtp.DSNNotifyFailure}; !reflect.DeepEqual(bob.Notify, want) {
+		t.Errorf("bob NOTIFY = %v, want %v", bob.Notify, want)
+	}
+	if carol.Notify != nil || carol.OriginalRecipient != "rfc822;carol@example.org" || bob.OriginalRecipient != "" {
+		t.Errorf("ORCPT/NOTIFY mixed up: bob %+v, carol %+v", bob, carol)
+	}
+	// The single retry counter becomes that many failed attempts each.
+	for _, r := range got.Recipients {
+		if r.failedAttempts() != 2 || r.LastError != "unknown error" {
+			t.Errorf("%s: %d failed attempts, last error %q", r.Address, r.failedAttempts(), r.LastError)
+		}
+	}
+}
+
+func TestDecodeMessage_Rejects(t *testing.T) {
+	for name, raw := range map[string]string{
+		"unknown version":    `{"v":99,"id":1,"recipients":[{"address":"bob@example.net"}]}`,
+		"no recipients":      `{"v":2,"id":1,"recipients":[]}`,
+		"legacy without to":  `{"id":1,"from":"alice@example.com","data":"x"}`,
+		"legacy empty list":  `{"id":1,"to":[],"data":"x"}`,
+		"empty recipient":    `{"v":2,"id":1,"recipients":[{"address":""}]}`,
+		"no ID":              `{"v":2,"recipients":[{"address":"bob@example.net"}]}`,
+		"not JSON":           `mail`,
+		"bad legacy to type": `{"id":1,"to":5}`,
+		"bad legacy address": `{"id":1,"from":"MAIL FROM:<a@b.c>","to":"RCPT TO:<bob>","data":"x"}`,
+		"bad legacy sender":  `{"id":1,"from":"MAIL FROM:<a@b","to":"RCPT TO:<bob@example.net>","data":"x"}`,
+		"null legacy rcpt":   `{"id":1,"to":"RCPT TO:<>","data":"x"}`,
+	} {
+		if msg, err := decodeMessage(raw); err == nil {
+			t.Errorf("%s: decoded to %+v, want an error", name, msg)
+		}
+	}
+}
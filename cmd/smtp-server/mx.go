@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"smtp-server/resolver"
+	"smtp-server/smtp"
+)
+
+// Resolver serves every DNS lookup made for delivery.
+var Resolver resolver.Resolver = net.DefaultResolver
+
+// mxPort is the port MX hosts are reached on. Only tests change it.
+var mxPort = "25"
+
+var (
+	// errNullMX is returned for domains that publish "MX 0 ." (RFC 7505).
+	errNullMX = &smtp.SMTPError{Code: 556, EnhancedCode: smtp.EnhancedCode{5, 1, 10}, Message: "Recipient domain does not accept mail"}
+	// errNoSuchDomain is returned when the domain has neither MX nor
+	// address records.
+	errNoSuchDomain = &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 2}, Message: "Recipient domain not found"}
+)
+
+// newResolver builds the caching resolver from a list of upstream
+// servers, or from /etc/resolv.conf if the list is empty.
+func newResolver(servers []string) (resolver.Resolver, error) {
+	if len(servers) == 0 {
+		return resolver.NewClientFromResolvConf("/etc/resolv.conf")
+	}
+
+	var list []string
+	for _, s := range servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		list = append(list, s)
+	}
+
+	return resolver.NewClient(list), nil
+}
+
+// lookupMX returns the hosts to try for domain, in order.
+func lookupMX(domain string) ([]string, error) {
+	hosts, err := resolver.MXHosts(context.Background(), Resolver, domain)
+	switch {
+	case errors.Is(err, resolver.ErrNullMX):
+		return nil, errNullMX
+	case errors.Is(err, resolver.ErrNoSuchDomain):
+		return nil, errNoSuchDomain
+	}
+
+	return hosts, err
+}
+
+// sendToMX tries every address of every MX host of the recipient's domain
+// in turn. One that cannot be reached, turns us away at the greeting or
+// EHLO/HELO, or answers 4xx makes us move on to the next; a 5xx reply
+// to MAIL, RCPT or DATA is final. The last error is returned if no host
+// took the message.
+func sendToMX(hosts []string, from, to, body string, opts *smtp.MailOptions) (*sendResult, error) {
+	var lastErr error
+	for _, host := range hosts {
+		addrs, err := Resolver.LookupIPAddr(context.Background(), host)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		for _, addr := range addrs {
+			res, err := SendSMTP(host, addr.IP.String(), from, to, body, opts)
+			var sessErr *sessionError
+			if err == nil || smtp.IsPermanent(err) && !errors.As(err, &sessErr) {
+				return res, err
+			}
+			lastErr = err
+		}
+	}
+
+	return nil, lastErr
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"smtp-server/resolver"
+	"smtp-server/smtp"
+)
+
+// fakeMX listens on addr, greets with greeting and answers RCPT with
+// rcptReply, accepting everything else. A greeting other than 220 is
+// followed by hanging up. It returns how many transactions reached RCPT.
+func fakeMX(t *testing.T, addr, greeting, rcptReply string) *atomic.Int32 {
+	t.Helper()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var rcpts atomic.Int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				conn.Write([]byte(greeting + "\r\n"))
+				if !strings.HasPrefix(greeting, "220") {
+					return
+				}
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch verb := strings.ToUpper(strings.Fields(line + " x")[0]); verb {
+					case "EHLO":
+						conn.Write([]byte("250 fake.example\r\n"))
+					case "RCPT":
+						rcpts.Add(1)
+						conn.Write([]byte(rcptReply + "\r\n"))
+					case "DATA":
+						conn.Write([]byte("354 Go ahead\r\n"))
+						for line != ".\r\n" {
+							if line, err = r.ReadString('\n'); err != nil {
+								return
+							}
+						}
+						conn.Write([]byte("250 Queued\r\n"))
+					case "QUIT":
+						conn.Write([]byte("221 Bye\r\n"))
+						return
+					default:
+						conn.Write([]byte("250 OK\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+
+	return &rcpts
+}
+
+// ─────────────────────────────────────────────
+// MX fallback
+// ─────────────────────────────────────────────
+
+func TestSendToMX_Fallback(t *testing.T) {
+	const greeting = "220 fake.example ESMTP"
+	cases := []struct {
+		name          string
+		firstGreeting string
+		first         string // "" means nothing listens
+		second        string
+		wantCode      int // 0 means delivered
+		wantAttempts  [2]int32
+	}{
+		{"unreachable", greeting, "", "250 OK", 0, [2]int32{0, 1}},
+		{"temporary", greeting, "451 4.3.0 Try later", "250 OK", 0, [2]int32{1, 1}},
+		{"permanent", greeting, "550 5.1.1 No such user", "250 OK", 550, [2]int32{1, 0}},
+		{"all temporary", greeting, "451 4.3.0 Try later", "452 4.2.2 Full", 452, [2]int32{1, 1}},
+		{"rejected at greeting", "554 5.7.1 Go away", "250 OK", "250 OK", 0, [2]int32{0, 1}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Both hosts share a port on different loopback addresses.
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, port, _ := net.SplitHostPort(l.Addr().String())
+			l.Close()
+
+			oldResolver, oldPort, oldHostname := Resolver, mxPort, Hostname
+			t.Cleanup(func() { Resolver, mxPort, Hostname = oldResolver, oldPort, oldHostname })
+			mxPort, Hostname = port, "mx.example.com"
+			Resolver = &resolver.Static{IP: map[string][]net.IPAddr{
+				"mx1.example.net": {{IP: net.ParseIP("127.0.0.1")}},
+				"mx2.example.net": {{IP: net.ParseIP("127.0.0.2")}},
+			}}
+
+			first := new(atomic.Int32)
+			if tc.first != "" {
+				first = fakeMX(t, "127.0.0.1:"+port, tc.firstGreeting, tc.first)
+			}
+			second := fakeMX(t, "127.0.0.2:"+port, greeting, tc.second)
+
+			_, err = sendToMX([]string{"mx1.example.net", "mx2.example.net"},
+				"alice@example.com", "bob@example.net", "Subject: hi\r\n\r\nhi\r\n", &smtp.MailOptions{})
+
+			var smtpErr *smtp.SMTPError
+			switch {
+			case tc.wantCode == 0 && err != nil:
+				t.Errorf("got %v, want delivered", err)
+			case tc.wantCode != 0 && (!errors.As(err, &smtpErr) || smtpErr.Code != tc.wantCode):
+				t.Errorf("got %v, want %d", err, tc.wantCode)
+			}
+			if got := [2]int32{first.Load(), second.Load()}; got != tc.wantAttempts {
+				t.Errorf("attempts per host %v, want %v", got, tc.wantAttempts)
+			}
+		})
+	}
+}
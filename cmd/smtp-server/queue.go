@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Every delivery worker moves the message it is working on from mail_queue
+// to its own processing list and only removes it from there once the message is
+// delivered or handed to the retry or failed queue. If the process dies in
+// between, its heartbeat expires and the reaper of a surviving process
+// puts the message back on mail_queue.
+const (
+	heartbeatInterval = 10 * time.Second
+	heartbeatTTL      = 30 * time.Second
+	reapInterval      = 30 * time.Second
+	// failedBodyTTL is how long the content of a message with failed
+	// recipients is kept after delivery has finished.
+	failedBodyTTL = 7 * 24 * time.Hour
+)
+
+// workerID names this process's processing lists and heartbeat key.
+var workerID string
+
+// processingKey names the processing list of delivery worker n of the
+// process id.
+func processingKey(id string, n int) string {
+	return fmt.Sprintf("mail_processing:%s:%d", id, n)
+}
+
+func heartbeatKey(id string) string {
+	return "worker:" + id
+}
+
+// beat marks this process alive for another heartbeatTTL.
+func beat() error {
+	return rdb.Set(context.Background(), heartbeatKey(workerID), time.Now().Unix(), heartbeatTTL).Err()
+}
+
+func heartbeatWorker() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := beat(); err != nil {
+			log.Println("Error refreshing worker heartbeat:", err)
+		}
+	}
+}
+
+func reaperWorker(ctx context.Context) {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := reapDeadWorkers(ctx); err != nil {
+			log.Println("Error reaping processing lists:", err)
+		}
+	}
+}
+
+// reapDeadWorkers returns the messages held by workers whose heartbeat has
+// expired to mail_queue. LMOVE is atomic, so reapers racing on the same
+// list cannot duplicate a message.
+func reapDeadWorkers(ctx context.Context) error {
+	iter := rdb.Scan(ctx, 0, "mail_processing:*", 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		id, _, _ := strings.Cut(strings.TrimPrefix(key, "mail_processing:"), ":")
+		if id == workerID {
+			continue
+		}
+
+		alive, err := rdb.Exists(ctx, heartbeatKey(id)).Result()
+		if err != nil {
+			return err
+		}
+		if alive > 0 {
+			continue
+		}
+
+		moved, err := requeueList(ctx, key)
+		if err != nil {
+			return err
+		}
+		if moved > 0 {
+			log.Printf("Requeued %d message(s) from dead worker %s", moved, id)
+		}
+	}
+
+	return iter.Err()
+}
+
+// requeueList moves everything on a processing list back to mail_queue.
+func requeueList(ctx context.Context, key string) (int, error) {
+	moved := 0
+	for {
+		err := rdb.LMove(ctx, key, "mail_queue", "RIGHT", "RIGHT").Err()
+		if err == redis.Nil {
+			return moved, nil
+		}
+		if err != nil {
+			return moved, err
+		}
+		moved++
+	}
+}
+
+// queueMessage stores body under the message's BodyKey and puts msg on
+// mail_queue, both in one transaction.
+func queueMessage(msg *QueuedMessage, body string) error {
+	msgJSON, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, msg.BodyKey, body, 0)
+		pipe.LPush(ctx, "mail_queue", msgJSON)
+		return nil
+	})
+	return err
+}
+
+// parkFailed copies msg to failed_mail_queue for inspection.
+func parkFailed(msg *QueuedMessage) {
+	msgJSON, _ := json.Marshal(msg)
+	if err := rdb.RPush(context.Background(), "failed_mail_queue", msgJSON).Err(); err != nil {
+		log.Println("Error parking failed message:", err)
+	}
+}
+
+// ack removes a finished message from the worker's processing list.
+func ack(processing, raw string) {
+	if err := rdb.LRem(context.Background(), processing, 1, raw).Err(); err != nil {
+		log.Println("Error acknowledging message:", err)
+	}
+}
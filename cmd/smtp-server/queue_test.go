@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// useRedis points rdb at the Redis on localhost for one test, as the
+// integration tests use it, and skips the test when there is none.
+func useRedis(t *testing.T) context.Context {
+	t.Helper()
+	ctx := context.Background()
+	client := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	pingCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if err := client.Ping(pingCtx).Err(); err != nil {
+		client.Close()
+		t.Skip("no Redis on localhost:6379:", err)
+	}
+
+	old := rdb
+	rdb = client
+	t.Cleanup(func() {
+		rdb = old
+		client.Close()
+	})
+	return ctx
+}
+
+// ─────────────────────────────────────────────
+// Processing lists
+// ─────────────────────────────────────────────
+
+func TestReapDeadWorkers(t *testing.T) {
+	ctx := useRedis(t)
+
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 10)
+	self, live, dead := "reap-self-"+suffix, "reap-live-"+suffix, "reap-dead-"+suffix
+	oldID := workerID
+	workerID = self
+	t.Cleanup(func() { workerID = oldID })
+
+	held := map[string]string{self: "self-msg-" + suffix, live: "live-msg-" + suffix, dead: "dead-msg-" + suffix}
+	t.Cleanup(func() {
+		for id, msg := range held {
+			rdb.Del(ctx, processingKey(id, 0), heartbeatKey(id))
+			rdb.LRem(ctx, "mail_queue", 0, msg)
+		}
+	})
+	for id, msg := range held {
+		if err := rdb.RPush(ctx, processingKey(id, 0), msg).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only the live worker has a heartbeat. This process is never reaped,
+	// heartbeat or not.
+	if err := rdb.Set(ctx, heartbeatKey(live), time.Now().Unix(), time.Minute).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reapDeadWorkers(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, wantHeld := range map[string]bool{self: true, live: true, dead: false} {
+		n, err := rdb.LLen(ctx, processingKey(id, 0)).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = rdb.LPos(ctx, "mail_queue", held[id], redis.LPosArgs{}).Result()
+		requeued := err == nil
+		if err != nil && err != redis.Nil {
+			t.Fatal(err)
+		}
+
+		if wantHeld && (n != 1 || requeued) {
+			t.Errorf("%s: %d left on its processing list, requeued %v; want it kept", id, n, requeued)
+		}
+		if !wantHeld && (n != 0 || !requeued) {
+			t.Errorf("%s: %d left on its processing list, requeued %v; want it back on mail_queue", id, n, requeued)
+		}
+	}
+}
+
+func TestRequeueList(t *testing.T) {
+	ctx := useRedis(t)
+
+	key := processingKey("requeue-"+strconv.FormatInt(time.Now().UnixNano(), 10), 0)
+	msgs := []string{"requeue-a-" + key, "requeue-b-" + key}
+	t.Cleanup(func() {
+		rdb.Del(ctx, key)
+		for _, m := range msgs {
+			rdb.LRem(ctx, "mail_queue", 0, m)
+		}
+	})
+	if err := rdb.RPush(ctx, key, msgs[0], msgs[1]).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := requeueList(ctx, key)
+	if err != nil || moved != 2 {
+		t.Fatalf("moved %d, %v; want 2", moved, err)
+	}
+	if moved, err := requeueList(ctx, key); err != nil || moved != 0 {
+		t.Errorf("second run moved %d, %v; want 0", moved, err)
+	}
+	for _, m := range msgs {
+		if _, err := rdb.LPos(ctx, "mail_queue", m, redis.LPosArgs{}).Result(); err != nil {
+			t.Errorf("%s not on mail_queue: %v", m, err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	// RetrySchedule is the delay before each retry of a failed delivery.
+	// Retries beyond its length keep using the last entry.
+	RetrySchedule []time.Duration
+	// MaxRetries is how many times a delivery is retried before the message
+	// is given up on.
+	MaxRetries int
+	// MaxQueueAge gives up on messages that have been queued this long,
+	// however many retries are left.
+	MaxQueueAge time.Duration
+)
+
+// schedulerBatch caps how many due messages one script run moves, so a
+// large backlog does not block Redis.
+const schedulerBatch = 100
+
+// moveDueScript moves every message whose retry time has come from the
+// retry ZSET back onto the delivery queue, in one atomic step so a message
+// is never lost or duplicated between the two.
+var moveDueScript = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, m in ipairs(due) do
+	redis.call('ZREM', KEYS[1], m)
+	redis.call('LPUSH', KEYS[2], m)
+end
+return #due
+`)
+
+// retryDelay returns how long to wait before retry number tries, counting
+// from 1.
+func retryDelay(tries int) time.Duration {
+	return RetrySchedule[min(tries, len(RetrySchedule))-1]
+}
+
+// retryLater handles a temporary failure for r: it schedules the next
+// attempt according to RetrySchedule and reports true, or reports false
+// once r has used up MaxRetries or msg has been queued for longer than
+// MaxQueueAge.
+func retryLater(msg *QueuedMessage, r *Recipient) bool {
+	tries := r.failedAttempts()
+	if tries > MaxRetries || time.Since(msg.QueuedAt) > MaxQueueAge {
+		return false
+	}
+
+	r.NextAttempt = time.Now().Add(retryDelay(tries))
+	log.Printf("Retry %d for %s to %s at %s: %s", tries, msg.IDString(), r.Address, r.NextAttempt.Format(time.RFC3339), r.LastError)
+	return true
+}
+
+// scheduleRetry puts msg on the retry queue for when its earliest pending
+// recipient is due.
+func scheduleRetry(msg *QueuedMessage) {
+	var next time.Time
+	for _, r := range msg.Pending() {
+		if next.IsZero() || r.NextAttempt.Before(next) {
+			next = r.NextAttempt
+		}
+	}
+
+	msgJSON, _ := json.Marshal(msg)
+	if err := rdb.ZAdd(context.Background(), "mail_retry_queue", redis.Z{
+		Score:  float64(next.Unix()),
+		Member: msgJSON,
+	}).Err(); err != nil {
+		log.Println("Error scheduling retry:", err)
+	}
+}
+
+// schedulerWorker moves messages back onto mail_queue once their retry
+// time has come.
+func schedulerWorker(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for {
+			moved, err := moveDueScript.Run(
+				context.Background(),
+				rdb,
+				[]string{"mail_retry_queue", "mail_queue"},
+				strconv.FormatInt(time.Now().Unix(), 10),
+				schedulerBatch,
+			).Int()
+			if err != nil {
+				log.Println("Error moving due retries:", err)
+				break
+			}
+			if moved < schedulerBatch {
+				break
+			}
+		}
+	}
+}
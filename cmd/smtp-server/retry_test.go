@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// setRetryPolicy sets the retry settings for one test.
+func setRetryPolicy(t *testing.T, schedule []time.Duration, maxRetries int, maxAge time.Duration) {
+	t.Helper()
+	oldSchedule, oldRetries, oldAge := RetrySchedule, MaxRetries, MaxQueueAge
+	t.Cleanup(func() { RetrySchedule, MaxRetries, MaxQueueAge = oldSchedule, oldRetries, oldAge })
+	RetrySchedule, MaxRetries, MaxQueueAge = schedule, maxRetries, maxAge
+}
+
+// failedRecipient returns a recipient that has failed tries times.
+func failedRecipient(tries int) *Recipient {
+	r := &Recipient{Address: "bob@example.net", Status: rcptPending}
+	for range tries {
+		r.record("", errors.New("connection refused"))
+	}
+	return r
+}
+
+// ─────────────────────────────────────────────
+// Retry policy
+// ─────────────────────────────────────────────
+
+func TestRetryDelay(t *testing.T) {
+	cases := []struct {
+		schedule []time.Duration
+		tries    int
+		want     time.Duration
+	}{
+		{[]time.Duration{time.Minute, 5 * time.Minute, time.Hour}, 1, time.Minute},
+		{[]time.Duration{time.Minute, 5 * time.Minute, time.Hour}, 2, 5 * time.Minute},
+		{[]time.Duration{time.Minute, 5 * time.Minute, time.Hour}, 3, time.Hour},
+		// Past the end of the schedule the last entry repeats.
+		{[]time.Duration{time.Minute, 5 * time.Minute, time.Hour}, 4, time.Hour},
+		{[]time.Duration{time.Minute, 5 * time.Minute, time.Hour}, 20, time.Hour},
+		{[]time.Duration{10 * time.Minute}, 1, 10 * time.Minute},
+		{[]time.Duration{10 * time.Minute}, 7, 10 * time.Minute},
+	}
+
+	for _, tc := range cases {
+		setRetryPolicy(t, tc.schedule, 100, time.Hour)
+		if got := retryDelay(tc.tries); got != tc.want {
+			t.Errorf("%v, try %d: got %v, want %v", tc.schedule, tc.tries, got, tc.want)
+		}
+	}
+}
+
+func TestRetryLater(t *testing.T) {
+	schedule := []time.Duration{time.Minute, time.Hour}
+	cases := []struct {
+		name  string
+		tries int
+		age   time.Duration
+		want  bool
+		delay time.Duration
+	}{
+		{"first failure", 1, 0, true, time.Minute},
+		{"beyond the schedule", 2, 0, true, time.Hour},
+		{"last retry", 3, 0, true, time.Hour},
+		{"out of retries", 4, 0, false, 0},
+		{"just young enough", 1, 48*time.Hour - time.Minute, true, time.Minute},
+		{"too old", 1, 48*time.Hour + time.Minute, false, 0},
+	}
+
+	for _, tc := range cases {
+		setRetryPolicy(t, schedule, 3, 48*time.Hour)
+		msg := &QueuedMessage{ID: 1, QueuedAt: time.Now().Add(-tc.age)}
+		r := failedRecipient(tc.tries)
+
+		before := time.Now()
+		if got := retryLater(msg, r); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+			continue
+		}
+		if !tc.want {
+			if !r.NextAttempt.IsZero() {
+				t.Errorf("%s: next attempt scheduled for %v after giving up", tc.name, r.NextAttempt)
+			}
+			continue
+		}
+		if delay := r.NextAttempt.Sub(before); delay < tc.delay || delay > tc.delay+time.Second {
+			t.Errorf("%s: next attempt in %v, want %v", tc.name, delay, tc.delay)
+		}
+	}
+}
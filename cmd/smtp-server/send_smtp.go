@@ -1,40 +1,146 @@
 package main
 
 import (
-	"bufio"
-	"fmt"
+	"crypto/tls"
+	"errors"
 	"net"
+	"smtp-server/smtp"
+	"strings"
 )
 
-func SendSMTP(host string, from string, to string, body string) error {
+// tlsPolicy says how much TLS outbound delivery insists on for a domain.
+type tlsPolicy int
 
-	conn, err := net.Dial("tcp", host+":25")
-	if err != nil {
-		return err
+const (
+	// tlsOpportunistic uses STARTTLS when offered, without verifying the
+	// certificate, and falls back to plaintext if the handshake fails.
+	tlsOpportunistic tlsPolicy = iota
+	// tlsRequired refuses to deliver without encryption.
+	tlsRequired
+	// tlsRequiredVerify also requires a certificate valid for the MX host.
+	tlsRequiredVerify
+)
+
+// TLSPolicies overrides the opportunistic default per destination domain.
+var TLSPolicies = map[string]tlsPolicy{}
+
+var errTLSUnavailable = errors.New("TLS required but not offered by remote")
+
+// tlsPolicies converts the delivery.tls_policies setting, whose names
+// the config package has already checked.
+func tlsPolicies(names map[string]string) map[string]tlsPolicy {
+	policies := make(map[string]tlsPolicy, len(names))
+	for domain, name := range names {
+		switch name {
+		case "required":
+			policies[domain] = tlsRequired
+		case "verify":
+			policies[domain] = tlsRequiredVerify
+		default:
+			policies[domain] = tlsOpportunistic
+		}
+	}
+
+	return policies
+}
+
+// sendResult is what a successful delivery learned about the remote.
+type sendResult struct {
+	Reply string
+	// TLS is nil if the message went out in plaintext.
+	TLS *tls.ConnectionState
+}
+
+// tlsSummary describes the negotiated TLS parameters for the delivery
+// record.
+func (r *sendResult) tlsSummary() string {
+	if r.TLS == nil {
+		return "none"
+	}
+	return tls.VersionName(r.TLS.Version) + " " + tls.CipherSuiteName(r.TLS.CipherSuite)
+}
+
+// SendSMTP delivers body to a single recipient through the MX host at
+// addr, with the MAIL parameters in opts, applying the TLS policy of the
+// recipient's domain. A rejection comes back as an *smtp.SMTPError, so the
+// caller can tell temporary from permanent ones.
+func SendSMTP(host string, addr string, from string, to string, body string, opts *smtp.MailOptions) (*sendResult, error) {
+	policy := TLSPolicies[strings.ToLower(getDomain(to))]
+
+	res, err := sendSMTP(host, addr, from, to, body, opts, policy, true)
+	var tlsErr *tlsHandshakeError
+	if policy == tlsOpportunistic && errors.As(err, &tlsErr) {
+		return sendSMTP(host, addr, from, to, body, opts, policy, false)
 	}
-	defer conn.Close()
 
-	reader := bufio.NewReader(conn)
+	return res, err
+}
+
+// tlsHandshakeError marks a failed STARTTLS negotiation, after which the
+// connection is unusable.
+type tlsHandshakeError struct {
+	err error
+}
 
-	// read 220 greeting
-	reader.ReadString('\n')
+func (e *tlsHandshakeError) Error() string { return "STARTTLS: " + e.err.Error() }
+func (e *tlsHandshakeError) Unwrap() error { return e.err }
 
-	fmt.Fprintf(conn, "HELO localhost\r\n")
-	reader.ReadString('\n')
+// sessionError marks a failure before the transaction: no connection, or
+// a rejection of the greeting or of EHLO/HELO. It is about the host, not
+// the message, so another MX may still take it.
+type sessionError struct {
+	err error
+}
 
-	fmt.Fprintf(conn, "MAIL FROM:<%s>\r\n", from)
-	reader.ReadString('\n')
+func (e *sessionError) Error() string { return e.err.Error() }
+func (e *sessionError) Unwrap() error { return e.err }
 
-	fmt.Fprintf(conn, "RCPT TO:<%s>\r\n", to)
-	reader.ReadString('\n')
+func sendSMTP(host, addr, from, to, body string, opts *smtp.MailOptions, policy tlsPolicy, useTLS bool) (*sendResult, error) {
+	c, err := smtp.Dial(net.JoinHostPort(addr, mxPort), smtp.DefaultClientTimeouts)
+	if err != nil {
+		return nil, &sessionError{err}
+	}
+	defer c.Close()
 
-	fmt.Fprintf(conn, "DATA\r\n")
-	reader.ReadString('\n')
+	if err := c.Hello(Hostname); err != nil {
+		return nil, &sessionError{err}
+	}
 
-	fmt.Fprintf(conn, "%s\r\n.\r\n", body)
-	reader.ReadString('\n')
+	offered, _ := c.Extension("STARTTLS")
+	switch {
+	case useTLS && offered:
+		config := &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: policy != tlsRequiredVerify,
+		}
+		if err := c.StartTLS(config); err != nil {
+			if smtp.IsPermanent(err) || policy != tlsOpportunistic {
+				return nil, err
+			}
+			return nil, &tlsHandshakeError{err}
+		}
+	case policy != tlsOpportunistic:
+		return nil, errTLSUnavailable
+	}
 
-	fmt.Fprintf(conn, "QUIT\r\n")
+	opts = c.Downgrade(opts, from, []string{to}, body)
+	if err := c.Mail(from, opts); err != nil {
+		return nil, err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return nil, err
+	}
+
+	reply, err := c.Data(strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	res := &sendResult{Reply: reply}
+	if state, ok := c.TLSConnectionState(); ok {
+		res.TLS = &state
+	}
 
-	return nil
+	c.Quit()
+	return res, nil
 }
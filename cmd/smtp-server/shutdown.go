@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"smtp-server/smtp"
+	"sync"
+	"time"
+)
+
+// ShutdownGrace is how long open sessions and running deliveries get to
+// finish after SIGTERM.
+var ShutdownGrace time.Duration
+
+// fetchTimeout bounds each wait on mail_queue, so workers notice shutdown.
+const fetchTimeout = time.Second
+
+// serve runs a listener and exits the process if it fails for any reason
+// other than shutdown.
+func serve(name, addr string, listen func() error) {
+	log.Printf("listening for %s on %s", name, addr)
+	if err := listen(); err != nil && !errors.Is(err, smtp.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
+
+// shutdown stops the listeners and waits up to ShutdownGrace for sessions
+// and delivery workers to finish. Messages the workers did not get to the
+// end of go back to mail_queue for another process.
+func shutdown(servers []*smtp.Server, workers *sync.WaitGroup) {
+	log.Println("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownGrace)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("Shutdown of %s: %v", srv.Addr, err)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Println("Delivery workers did not finish in time")
+	}
+	wg.Wait()
+
+	bg := context.Background()
+	for n := range DeliveryWorkers {
+		moved, err := requeueList(bg, processingKey(workerID, n))
+		if err != nil {
+			log.Println("Error requeueing unfinished messages:", err)
+		}
+		if moved > 0 {
+			log.Printf("Requeued %d unfinished message(s)", moved)
+		}
+	}
+	rdb.Del(bg, heartbeatKey(workerID))
+
+	log.Println("shutdown complete")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DeliveryWorkers is how many messages are delivered in parallel.
+var DeliveryWorkers int
+
+// throttleDelay is how long a message waits before it is tried again when
+// its domain has no free connection slot.
+const throttleDelay = 15 * time.Second
+
+// deferral is returned for a recipient that was not attempted because its
+// domain is at a limit. It does not count as a failed attempt.
+type deferral struct {
+	wait time.Duration
+}
+
+func (d *deferral) Error() string {
+	return "deferred for " + d.wait.String()
+}
+
+// domainSlots hands out per-domain connection slots. They are counted in
+// this process only; the per-minute rate is what is shared through Redis.
+type domainSlots struct {
+	mu    sync.Mutex
+	inUse map[string]int
+}
+
+var slots = &domainSlots{inUse: make(map[string]int)}
+
+// acquire takes a slot for domain without waiting, and reports false if
+// all delivery.domain_max_conns are taken. A taken slot must be given back
+// with release.
+func (s *domainSlots) acquire(domain string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	limit := cfg.Load().Delivery.DomainMaxConns
+	if limit > 0 && s.inUse[domain] >= limit {
+		return false
+	}
+	s.inUse[domain]++
+	return true
+}
+
+func (s *domainSlots) release(domain string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.inUse[domain]--; s.inUse[domain] <= 0 {
+		delete(s.inUse, domain)
+	}
+}
+
+// allowDomainSend counts a message against the rate limit of domain for
+// the current minute. If the limit is reached it returns false and how
+// long until the next minute starts.
+func allowDomainSend(domain string) (bool, time.Duration) {
+	limit := cfg.Load().DomainRate(domain)
+	if limit <= 0 {
+		return true, 0
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	window := now.Truncate(time.Minute)
+	key := fmt.Sprintf("rate:domain:%s:%d", domain, window.Unix())
+
+	count, err := rdb.Incr(ctx, key).Result()
+	if err != nil {
+		// Better to send a little too fast than not at all.
+		return true, 0
+	}
+	if count == 1 {
+		rdb.Expire(ctx, key, 2*time.Minute)
+	}
+	if count > int64(limit) {
+		return false, window.Add(time.Minute).Sub(now)
+	}
+
+	return true, 0
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"smtp-server/config"
+)
+
+// useConfig puts c in effect for one test.
+func useConfig(t *testing.T, c *config.Config) {
+	t.Helper()
+	old := cfg.Load()
+	cfg.Store(c)
+	t.Cleanup(func() { cfg.Store(old) })
+}
+
+// ─────────────────────────────────────────────
+// Per-domain limits
+// ─────────────────────────────────────────────
+
+func TestDomainSlots(t *testing.T) {
+	c := config.Default()
+	c.Delivery.DomainMaxConns = 2
+	useConfig(t, c)
+	s := &domainSlots{inUse: make(map[string]int)}
+
+	for i := range 2 {
+		if !s.acquire("example.net") {
+			t.Fatalf("slot %d refused below the limit", i+1)
+		}
+	}
+	if s.acquire("example.net") {
+		t.Error("slot handed out beyond the limit")
+	}
+	if !s.acquire("example.org") {
+		t.Error("another domain refused")
+	}
+
+	s.release("example.net")
+	if !s.acquire("example.net") {
+		t.Error("released slot not handed out again")
+	}
+	s.release("example.net")
+	s.release("example.net")
+	s.release("example.org")
+	if len(s.inUse) != 0 {
+		t.Errorf("slots left after releasing all: %v", s.inUse)
+	}
+
+	c.Delivery.DomainMaxConns = 0
+	for i := range 10 {
+		if !s.acquire("example.net") {
+			t.Fatalf("slot %d refused without a limit", i+1)
+		}
+	}
+}
+
+func TestAllowDomainSend(t *testing.T) {
+	ctx := useRedis(t)
+
+	domain := "rate-" + strconv.FormatInt(time.Now().UnixNano(), 10) + ".example"
+	c := config.Default()
+	c.Delivery.DomainRates = map[string]int{domain: 2}
+	useConfig(t, c)
+
+	// All sends have to fall into the same minute.
+	if left := time.Until(time.Now().Truncate(time.Minute).Add(time.Minute)); left < 2*time.Second {
+		time.Sleep(left)
+	}
+	t.Cleanup(func() {
+		keys, _ := rdb.Keys(ctx, "rate:domain:"+domain+":*").Result()
+		if len(keys) > 0 {
+			rdb.Del(ctx, keys...)
+		}
+	})
+
+	for i := range 2 {
+		if ok, wait := allowDomainSend(domain); !ok || wait != 0 {
+			t.Fatalf("send %d: got %v, %v; want it allowed", i+1, ok, wait)
+		}
+	}
+	ok, wait := allowDomainSend(domain)
+	// The wait runs to the start of the next minute.
+	nextMinute := time.Until(time.Now().Truncate(time.Minute).Add(time.Minute))
+	if ok || wait <= 0 || wait > time.Minute || wait < nextMinute-time.Second {
+		t.Errorf("send over the limit: got %v, %v; want refused for about %v", ok, wait, nextMinute)
+	}
+
+	// Domains without a rate are never counted.
+	if ok, wait := allowDomainSend("other-" + domain); !ok || wait != 0 {
+		t.Errorf("unlimited domain: got %v, %v", ok, wait)
+	}
+}
@@ -0,0 +1,473 @@
+// Package config loads the settings shared by smtp-server and http-server
+// from a YAML or TOML file, environment variables and command-line flags,
+// in increasing order of precedence.
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/redis/go-redis/v9"
+	"go.yaml.in/yaml/v3"
+	"golang.org/x/net/idna"
+)
+
+// Config is the complete configuration of both binaries. Durations are
+// written as Go durations ("90s", "4h"), the ID epoch as an RFC 3339 time.
+type Config struct {
+	// Hostname is announced in greetings and outbound EHLO. It defaults to
+	// the system host name.
+	Hostname string `yaml:"hostname" toml:"hostname"`
+	// LocalDomains are the domains whose mail is delivered to local
+	// mailboxes.
+	LocalDomains []string `yaml:"local_domains" toml:"local_domains"`
+	// Postmaster is the local mailbox that mail for the bare <Postmaster>
+	// recipient goes to. It defaults to postmaster at the first local
+	// domain.
+	Postmaster string `yaml:"postmaster" toml:"postmaster"`
+	RedisURL   string `yaml:"redis_url" toml:"redis_url"`
+	// IDEpoch is the start time of the message ID generator. Changing it
+	// after messages have been queued can reuse IDs.
+	IDEpoch time.Time `yaml:"id_epoch" toml:"id_epoch"`
+	// ShutdownGrace is how long sessions, requests and deliveries get to
+	// finish after SIGTERM.
+	ShutdownGrace time.Duration `yaml:"shutdown_grace" toml:"shutdown_grace"`
+
+	SMTP     SMTP     `yaml:"smtp" toml:"smtp"`
+	HTTP     HTTP     `yaml:"http" toml:"http"`
+	Auth     Auth     `yaml:"auth" toml:"auth"`
+	Delivery Delivery `yaml:"delivery" toml:"delivery"`
+}
+
+// SMTP configures the listeners of smtp-server.
+type SMTP struct {
+	// Addr is the submission listener.
+	Addr string `yaml:"addr" toml:"addr"`
+	// MXAddr is the inbound MX listener, disabled when empty.
+	MXAddr string `yaml:"mx_addr" toml:"mx_addr"`
+	// MXGreetingDelay holds back the MX greeting and turns away clients
+	// that talk before it.
+	MXGreetingDelay time.Duration `yaml:"mx_greeting_delay" toml:"mx_greeting_delay"`
+
+	TLS      TLS      `yaml:"tls" toml:"tls"`
+	Timeouts Timeouts `yaml:"timeouts" toml:"timeouts"`
+	// MaxLineLength caps command lines, CRLF included.
+	MaxLineLength int `yaml:"max_line_length" toml:"max_line_length"`
+	// MaxErrors closes a session after that many 5xx replies.
+	MaxErrors int `yaml:"max_errors" toml:"max_errors"`
+	// MaxConns and MaxConnsPerIP cap the open sessions of each listener
+	// in total and per client address.
+	MaxConns      int `yaml:"max_conns" toml:"max_conns"`
+	MaxConnsPerIP int `yaml:"max_conns_per_ip" toml:"max_conns_per_ip"`
+	// MaxRecipients caps RCPT commands per transaction, 0 means no limit.
+	MaxRecipients int `yaml:"max_recipients" toml:"max_recipients"`
+	// MaxMessageSize caps messages in bytes and is advertised with SIZE,
+	// 0 means no limit.
+	MaxMessageSize int64 `yaml:"max_message_size" toml:"max_message_size"`
+
+	Extensions Extensions `yaml:"extensions" toml:"extensions"`
+}
+
+// Extensions turns the optional ESMTP extensions of both listeners on and
+// off; see smtp.Extensions.
+type Extensions struct {
+	Pipelining          bool `yaml:"pipelining" toml:"pipelining"`
+	EnhancedStatusCodes bool `yaml:"enhancedstatuscodes" toml:"enhancedstatuscodes"`
+	DSN                 bool `yaml:"dsn" toml:"dsn"`
+	EightBitMIME        bool `yaml:"8bitmime" toml:"8bitmime"`
+	Chunking            bool `yaml:"chunking" toml:"chunking"`
+	// BinaryMIME needs Chunking.
+	BinaryMIME bool `yaml:"binarymime" toml:"binarymime"`
+	SMTPUTF8   bool `yaml:"smtputf8" toml:"smtputf8"`
+}
+
+// Timeouts bound each phase of an SMTP session; see smtp.Timeouts. Zero
+// means no limit.
+type Timeouts struct {
+	Greeting        time.Duration `yaml:"greeting" toml:"greeting"`
+	Command         time.Duration `yaml:"command" toml:"command"`
+	DataBlock       time.Duration `yaml:"data_block" toml:"data_block"`
+	DataTermination time.Duration `yaml:"data_termination" toml:"data_termination"`
+}
+
+// TLS enables STARTTLS and implicit TLS when Cert and Key are set.
+type TLS struct {
+	Cert string `yaml:"cert" toml:"cert"`
+	Key  string `yaml:"key" toml:"key"`
+	// Addr is the implicit TLS listener.
+	Addr string `yaml:"addr" toml:"addr"`
+	// AllowInsecureAuth permits AUTH before STARTTLS.
+	AllowInsecureAuth bool `yaml:"allow_insecure_auth" toml:"allow_insecure_auth"`
+}
+
+// Enabled reports whether a certificate is configured.
+func (t TLS) Enabled() bool {
+	return t.Cert != "" && t.Key != ""
+}
+
+// HTTP configures http-server.
+type HTTP struct {
+	Addr string `yaml:"addr" toml:"addr"`
+}
+
+// Auth limits login attempts.
+type Auth struct {
+	// IPLimit and UserLimit cap AUTH attempts per client address and per
+	// user name within Window.
+	IPLimit   int64         `yaml:"ip_limit" toml:"ip_limit"`
+	UserLimit int64         `yaml:"user_limit" toml:"user_limit"`
+	Window    time.Duration `yaml:"window" toml:"window"`
+	// MaxFails failed logins lock the account for Lockout, longer for
+	// repeat offenders.
+	MaxFails int           `yaml:"max_fails" toml:"max_fails"`
+	Lockout  time.Duration `yaml:"lockout" toml:"lockout"`
+}
+
+// Delivery configures the outbound queue.
+type Delivery struct {
+	// Workers is how many messages are delivered in parallel.
+	Workers int `yaml:"workers" toml:"workers"`
+	// DomainMaxConns caps simultaneous deliveries to one domain from each
+	// process, 0 means no limit. Unlike DomainRates it is not shared, so N
+	// processes may open N times as many connections.
+	DomainMaxConns int `yaml:"domain_max_conns" toml:"domain_max_conns"`
+	// DomainRates caps messages per minute per domain across all
+	// processes. The "*" entry applies to other domains.
+	DomainRates   map[string]int  `yaml:"domain_rates" toml:"domain_rates"`
+	RetrySchedule []time.Duration `yaml:"retry_schedule" toml:"retry_schedule"`
+	MaxRetries    int             `yaml:"max_retries" toml:"max_retries"`
+	MaxQueueAge   time.Duration   `yaml:"max_queue_age" toml:"max_queue_age"`
+	// DelayWarning is how long a message waits before the sender is told
+	// it is delayed, 0 disables the warning.
+	DelayWarning time.Duration `yaml:"delay_warning" toml:"delay_warning"`
+	// TLSPolicies maps a destination domain to opportunistic, required or
+	// verify.
+	TLSPolicies map[string]string `yaml:"tls_policies" toml:"tls_policies"`
+	// DNSServers are queried for MX records instead of /etc/resolv.conf.
+	DNSServers []string `yaml:"dns_servers" toml:"dns_servers"`
+}
+
+// TLSPolicyNames are the values allowed in Delivery.TLSPolicies.
+var TLSPolicyNames = []string{"opportunistic", "required", "verify"}
+
+// Default returns the built-in configuration.
+func Default() *Config {
+	return &Config{
+		LocalDomains:  []string{"myserver.local"},
+		RedisURL:      "redis://localhost:6379/0",
+		IDEpoch:       time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC),
+		ShutdownGrace: 30 * time.Second,
+		SMTP: SMTP{
+			Addr:            ":8000",
+			MXGreetingDelay: 2 * time.Second,
+			TLS:             TLS{Addr: ":465"},
+			Timeouts: Timeouts{
+				Greeting:        5 * time.Minute,
+				Command:         5 * time.Minute,
+				DataBlock:       3 * time.Minute,
+				DataTermination: 10 * time.Minute,
+			},
+			MaxLineLength:  2048,
+			MaxErrors:      20,
+			MaxConns:       1000,
+			MaxConnsPerIP:  20,
+			MaxRecipients:  100,
+			MaxMessageSize: 25 << 20,
+			Extensions: Extensions{
+				Pipelining:          true,
+				EnhancedStatusCodes: true,
+				DSN:                 true,
+				EightBitMIME:        true,
+				Chunking:            true,
+				BinaryMIME:          true,
+				SMTPUTF8:            true,
+			},
+		},
+		HTTP: HTTP{Addr: ":9000"},
+		Auth: Auth{
+			IPLimit:   20,
+			UserLimit: 5,
+			Window:    5 * time.Minute,
+			MaxFails:  5,
+			Lockout:   10 * time.Second,
+		},
+		Delivery: Delivery{
+			Workers:        8,
+			DomainMaxConns: 5,
+			DomainRates:    map[string]int{},
+			RetrySchedule: []time.Duration{
+				time.Minute,
+				5 * time.Minute,
+				30 * time.Minute,
+				2 * time.Hour,
+				4 * time.Hour,
+				8 * time.Hour,
+				16 * time.Hour,
+			},
+			MaxRetries:   15,
+			MaxQueueAge:  5 * 24 * time.Hour,
+			DelayWarning: 4 * time.Hour,
+			TLSPolicies:  map[string]string{},
+		},
+	}
+}
+
+// Load reads the file at path, if any, over the defaults, applies the
+// environment and validates the result.
+func Load(path string) (*Config, error) {
+	c, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.finish(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func load(path string) (*Config, error) {
+	c := Default()
+	if path != "" {
+		if err := c.readFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// readFile decodes path over c, choosing the format by extension. Unknown
+// keys are an error, so a misspelt setting is not silently ignored.
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(data), c)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("%s: unknown setting %q", path, undecoded[0].String())
+		}
+	default:
+		return fmt.Errorf("%s: unsupported config format %q, use .yaml or .toml", path, ext)
+	}
+
+	return nil
+}
+
+// finish fills in derived defaults and validates c.
+func (c *Config) finish() error {
+	if c.Hostname == "" {
+		name, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		c.Hostname = name
+	}
+	c.normalize()
+
+	return c.Validate()
+}
+
+// normalize brings domain names to the form they are compared in:
+// lower-case, with internationalised labels in their ASCII form.
+func (c *Config) normalize() {
+	for i, d := range c.LocalDomains {
+		c.LocalDomains[i] = normalizeDomain(d)
+	}
+	c.Delivery.DomainRates = normalizeKeys(c.Delivery.DomainRates)
+	c.Delivery.TLSPolicies = normalizeKeys(c.Delivery.TLSPolicies)
+}
+
+func normalizeDomain(d string) string {
+	d = strings.TrimSpace(d)
+	if ascii, err := idna.Lookup.ToASCII(d); err == nil {
+		d = ascii
+	}
+	return strings.ToLower(d)
+}
+
+func normalizeKeys[V any](m map[string]V) map[string]V {
+	out := make(map[string]V, len(m))
+	for k, v := range m {
+		out[normalizeDomain(k)] = v
+	}
+
+	return out
+}
+
+// Validate reports every problem with c at once.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Hostname != "", "hostname: must be set")
+	check(len(c.LocalDomains) > 0, "local_domains: at least one domain is required")
+	for _, d := range c.LocalDomains {
+		check(validDomain(d), "local_domains: bad domain %q", d)
+	}
+	if c.Postmaster != "" {
+		_, domain, ok := strings.Cut(c.Postmaster, "@")
+		check(ok && c.IsLocalDomain(domain), "postmaster: %q is not in one of local_domains", c.Postmaster)
+	}
+	if _, err := redis.ParseURL(c.RedisURL); err != nil {
+		errs = append(errs, fmt.Errorf("redis_url: %w", err))
+	}
+	check(!c.IDEpoch.IsZero() && c.IDEpoch.Before(time.Now()), "id_epoch: must be in the past")
+	check(c.ShutdownGrace > 0, "shutdown_grace: must be positive")
+
+	errs = append(errs, checkAddr("smtp.addr", c.SMTP.Addr, true))
+	errs = append(errs, checkAddr("smtp.mx_addr", c.SMTP.MXAddr, false))
+	errs = append(errs, checkAddr("http.addr", c.HTTP.Addr, true))
+	tlsConf := c.SMTP.TLS
+	check((tlsConf.Cert == "") == (tlsConf.Key == ""), "smtp.tls: cert and key must be set together")
+	if tlsConf.Enabled() {
+		errs = append(errs, checkAddr("smtp.tls.addr", tlsConf.Addr, true))
+		if _, err := tls.LoadX509KeyPair(tlsConf.Cert, tlsConf.Key); err != nil {
+			errs = append(errs, fmt.Errorf("smtp.tls: %w", err))
+		}
+	}
+
+	t := c.SMTP.Timeouts
+	check(t.Greeting >= 0 && t.Command >= 0 && t.DataBlock >= 0 && t.DataTermination >= 0, "smtp.timeouts: must not be negative")
+	check(c.SMTP.MaxLineLength == 0 || c.SMTP.MaxLineLength >= 512, "smtp.max_line_length: must be at least 512, as RFC 5321 requires")
+	check(c.SMTP.MXGreetingDelay >= 0, "smtp.mx_greeting_delay: must not be negative")
+	check(c.SMTP.MaxErrors >= 0, "smtp.max_errors: must not be negative")
+	check(c.SMTP.MaxConns >= 0, "smtp.max_conns: must not be negative")
+	check(c.SMTP.MaxConnsPerIP >= 0, "smtp.max_conns_per_ip: must not be negative")
+	check(c.SMTP.MaxRecipients >= 0, "smtp.max_recipients: must not be negative")
+	check(c.SMTP.MaxMessageSize >= 0, "smtp.max_message_size: must not be negative")
+	check(!c.SMTP.Extensions.BinaryMIME || c.SMTP.Extensions.Chunking, "smtp.extensions.binarymime: needs chunking")
+
+	a := c.Auth
+	check(a.IPLimit > 0, "auth.ip_limit: must be positive")
+	check(a.UserLimit > 0, "auth.user_limit: must be positive")
+	check(a.Window > 0, "auth.window: must be positive")
+	check(a.MaxFails > 0, "auth.max_fails: must be positive")
+	check(a.Lockout > 0, "auth.lockout: must be positive")
+
+	d := c.Delivery
+	check(d.Workers > 0, "delivery.workers: must be positive")
+	check(d.DomainMaxConns >= 0, "delivery.domain_max_conns: must not be negative")
+	for domain, n := range d.DomainRates {
+		check(n >= 0, "delivery.domain_rates: bad rate %d for %s", n, domain)
+	}
+	check(len(d.RetrySchedule) > 0, "delivery.retry_schedule: at least one delay is required")
+	for _, delay := range d.RetrySchedule {
+		check(delay > 0, "delivery.retry_schedule: delay %s must be positive", delay)
+	}
+	check(d.MaxRetries >= 0, "delivery.max_retries: must not be negative")
+	check(d.MaxQueueAge > 0, "delivery.max_queue_age: must be positive")
+	check(d.DelayWarning >= 0, "delivery.delay_warning: must not be negative")
+	for domain, name := range d.TLSPolicies {
+		check(slices.Contains(TLSPolicyNames, name), "delivery.tls_policies: unknown policy %q for %s", name, domain)
+	}
+	for _, s := range d.DNSServers {
+		check(strings.TrimSpace(s) != "", "delivery.dns_servers: empty server")
+	}
+
+	return errors.Join(errs...)
+}
+
+func checkAddr(name, addr string, required bool) error {
+	if addr == "" {
+		if required {
+			return fmt.Errorf("%s: must be set", name)
+		}
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	return nil
+}
+
+func validDomain(d string) bool {
+	if d == "" || len(d) > 255 || strings.ContainsAny(d, "@ \t") {
+		return false
+	}
+	for _, label := range strings.Split(d, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// IsLocalDomain reports whether mail for domain is delivered locally. An
+// internationalised domain may be given in either form.
+func (c *Config) IsLocalDomain(domain string) bool {
+	return slices.Contains(c.LocalDomains, normalizeDomain(domain))
+}
+
+// PostmasterAddress returns the mailbox that receives mail for the bare
+// <Postmaster> recipient.
+func (c *Config) PostmasterAddress() string {
+	if c.Postmaster != "" || len(c.LocalDomains) == 0 {
+		return c.Postmaster
+	}
+	return "postmaster@" + c.LocalDomains[0]
+}
+
+// DomainRate returns the messages per minute allowed for domain, 0 if
+// unlimited.
+func (c *Config) DomainRate(domain string) int {
+	if n, ok := c.Delivery.DomainRates[domain]; ok {
+		return n
+	}
+	return c.Delivery.DomainRates["*"]
+}
+
+// Reloadable lists what a running server picks up on SIGHUP.
+const Reloadable = "local_domains, postmaster, smtp.max_recipients, smtp.max_message_size, auth, delivery.domain_max_conns, delivery.domain_rates and the TLS certificate"
+
+// Reload returns c with the settings in Reloadable taken from next, and
+// whether next changes anything else, which only a restart applies. A
+// certificate can be swapped but TLS not turned on or off.
+func (c *Config) Reload(next *Config) (*Config, bool) {
+	r := *c
+	r.LocalDomains = next.LocalDomains
+	r.Postmaster = next.Postmaster
+	r.SMTP.MaxRecipients = next.SMTP.MaxRecipients
+	r.SMTP.MaxMessageSize = next.SMTP.MaxMessageSize
+	r.Auth = next.Auth
+	r.Delivery.DomainMaxConns = next.Delivery.DomainMaxConns
+	r.Delivery.DomainRates = next.Delivery.DomainRates
+	if c.SMTP.TLS.Enabled() && next.SMTP.TLS.Enabled() {
+		r.SMTP.TLS.Cert, r.SMTP.TLS.Key = next.SMTP.TLS.Cert, next.SMTP.TLS.Key
+	}
+
+	return &r, !reflect.DeepEqual(&r, next)
+}
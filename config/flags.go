@@ -0,0 +1,303 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// setting is a value that can be given as an environment variable or a
+// flag, both written the same way.
+type setting struct {
+	env, flag string
+	usage     string
+	isBool    bool
+	set       func(c *Config, v string) error
+}
+
+var settings = []setting{
+	{env: "SMTP_HOSTNAME", flag: "hostname", usage: "host name announced in greetings and EHLO",
+		set: func(c *Config, v string) error { c.Hostname = v; return nil }},
+	{env: "SMTP_LOCAL_DOMAINS", flag: "local-domains", usage: "comma separated domains delivered locally",
+		set: func(c *Config, v string) error { c.LocalDomains = splitList(v); return nil }},
+	{env: "SMTP_POSTMASTER", flag: "postmaster", usage: "local mailbox receiving mail for <Postmaster>",
+		set: func(c *Config, v string) error { c.Postmaster = v; return nil }},
+	{env: "REDIS_URL", flag: "redis-url", usage: "Redis URL",
+		set: func(c *Config, v string) error { c.RedisURL = v; return nil }},
+	{env: "SMTP_ID_EPOCH", flag: "id-epoch", usage: "start time of the message ID generator (RFC 3339)",
+		set: func(c *Config, v string) (err error) { c.IDEpoch, err = time.Parse(time.RFC3339, v); return }},
+	{env: "SMTP_SHUTDOWN_GRACE", flag: "shutdown-grace", usage: "time given to work in progress on SIGTERM",
+		set: durationSetter(func(c *Config) *time.Duration { return &c.ShutdownGrace })},
+
+	{env: "SMTP_ADDR", flag: "smtp-addr", usage: "submission listen address",
+		set: func(c *Config, v string) error { c.SMTP.Addr = v; return nil }},
+	{env: "SMTP_MX_ADDR", flag: "mx-addr", usage: "inbound MX listen address, empty to disable",
+		set: func(c *Config, v string) error { c.SMTP.MXAddr = v; return nil }},
+	{env: "SMTP_MX_GREETING_DELAY", flag: "mx-greeting-delay", usage: "MX greeting delay for catching early talkers, 0 to disable",
+		set: durationSetter(func(c *Config) *time.Duration { return &c.SMTP.MXGreetingDelay })},
+	{env: "SMTP_TLS_CERT", flag: "tls-cert", usage: "TLS certificate file",
+		set: func(c *Config, v string) error { c.SMTP.TLS.Cert = v; return nil }},
+	{env: "SMTP_TLS_KEY", flag: "tls-key", usage: "TLS key file",
+		set: func(c *Config, v string) error { c.SMTP.TLS.Key = v; return nil }},
+	{env: "SMTP_TLS_ADDR", flag: "tls-addr", usage: "implicit TLS listen address",
+		set: func(c *Config, v string) error { c.SMTP.TLS.Addr = v; return nil }},
+	{env: "SMTP_ALLOW_INSECURE_AUTH", flag: "allow-insecure-auth", usage: "allow AUTH without TLS", isBool: true,
+		set: func(c *Config, v string) (err error) {
+			c.SMTP.TLS.AllowInsecureAuth, err = strconv.ParseBool(v)
+			return
+		}},
+	{env: "SMTP_TIMEOUT_GREETING", flag: "timeout-greeting", usage: "time from connecting to the first command",
+		set: durationSetter(func(c *Config) *time.Duration { return &c.SMTP.Timeouts.Greeting })},
+	{env: "SMTP_TIMEOUT_COMMAND", flag: "timeout-command", usage: "time allowed for each command",
+		set: durationSetter(func(c *Config) *time.Duration { return &c.SMTP.Timeouts.Command })},
+	{env: "SMTP_TIMEOUT_DATA_BLOCK", flag: "timeout-data-block", usage: "longest wait for message content",
+		set: durationSetter(func(c *Config) *time.Duration { return &c.SMTP.Timeouts.DataBlock })},
+	{env: "SMTP_TIMEOUT_DATA_TERMINATION", flag: "timeout-data-termination", usage: "time allowed for a whole message transfer",
+		set: durationSetter(func(c *Config) *time.Duration { return &c.SMTP.Timeouts.DataTermination })},
+	{env: "SMTP_MAX_LINE_LENGTH", flag: "max-line-length", usage: "longest command line accepted",
+		set: func(c *Config, v string) (err error) { c.SMTP.MaxLineLength, err = strconv.Atoi(v); return }},
+	{env: "SMTP_MAX_ERRORS", flag: "max-errors", usage: "5xx replies before a session is closed",
+		set: func(c *Config, v string) (err error) { c.SMTP.MaxErrors, err = strconv.Atoi(v); return }},
+	{env: "SMTP_MAX_CONNS", flag: "max-conns", usage: "open sessions per listener",
+		set: func(c *Config, v string) (err error) { c.SMTP.MaxConns, err = strconv.Atoi(v); return }},
+	{env: "SMTP_MAX_CONNS_PER_IP", flag: "max-conns-per-ip", usage: "open sessions per listener and client address",
+		set: func(c *Config, v string) (err error) { c.SMTP.MaxConnsPerIP, err = strconv.Atoi(v); return }},
+	{env: "SMTP_MAX_RECIPIENTS", flag: "max-recipients", usage: "recipients per message, 0 for no limit",
+		set: func(c *Config, v string) (err error) { c.SMTP.MaxRecipients, err = strconv.Atoi(v); return }},
+	{env: "SMTP_MAX_MESSAGE_SIZE", flag: "max-message-size", usage: "message size in bytes, 0 for no limit",
+		set: func(c *Config, v string) (err error) {
+			c.SMTP.MaxMessageSize, err = strconv.ParseInt(v, 10, 64)
+			return
+		}},
+	extSetting("PIPELINING", func(c *Config) *bool { return &c.SMTP.Extensions.Pipelining }),
+	extSetting("ENHANCEDSTATUSCODES", func(c *Config) *bool { return &c.SMTP.Extensions.EnhancedStatusCodes }),
+	extSetting("DSN", func(c *Config) *bool { return &c.SMTP.Extensions.DSN }),
+	extSetting("8BITMIME", func(c *Config) *bool { return &c.SMTP.Extensions.EightBitMIME }),
+	extSetting("CHUNKING", func(c *Config) *bool { return &c.SMTP.Extensions.Chunking }),
+	extSetting("BINARYMIME", func(c *Config) *bool { return &c.SMTP.Extensions.BinaryMIME }),
+	extSetting("SMTPUTF8", func(c *Config) *bool { return &c.SMTP.Extensions.SMTPUTF8 }),
+	{env: "HTTP_ADDR", flag: "http-addr", usage: "user service listen address",
+		set: func(c *Config, v string) error { c.HTTP.Addr = v; return nil }},
+
+	{env: "SMTP_AUTH_IP_LIMIT", flag: "auth-ip-limit", usage: "AUTH attempts per client address and window",
+		set: func(c *Config, v string) (err error) { c.Auth.IPLimit, err = strconv.ParseInt(v, 10, 64); return }},
+	{env: "SMTP_AUTH_USER_LIMIT", flag: "auth-user-limit", usage: "AUTH attempts per user and window",
+		set: func(c *Config, v string) (err error) { c.Auth.UserLimit, err = strconv.ParseInt(v, 10, 64); return }},
+	{env: "SMTP_AUTH_WINDOW", flag: "auth-window", usage: "window of the AUTH rate limits",
+		set: durationSetter(func(c *Config) *time.Duration { return &c.Auth.Window })},
+	{env: "SMTP_AUTH_MAX_FAILS", flag: "auth-max-fails", usage: "failed logins before an account is locked",
+		set: func(c *Config, v string) (err error) { c.Auth.MaxFails, err = strconv.Atoi(v); return }},
+	{env: "SMTP_AUTH_LOCKOUT", flag: "auth-lockout", usage: "how long a locked account stays locked",
+		set: durationSetter(func(c *Config) *time.Duration { return &c.Auth.Lockout })},
+
+	{env: "SMTP_DELIVERY_WORKERS", flag: "delivery-workers", usage: "messages delivered in parallel",
+		set: func(c *Config, v string) (err error) { c.Delivery.Workers, err = strconv.Atoi(v); return }},
+	{env: "SMTP_DOMAIN_MAX_CONNS", flag: "domain-max-conns", usage: "simultaneous deliveries per domain from this process",
+		set: func(c *Config, v string) (err error) { c.Delivery.DomainMaxConns, err = strconv.Atoi(v); return }},
+	{env: "SMTP_DOMAIN_RATE", flag: "domain-rate", usage: `messages per minute per domain, as "domain=n,*=n"`,
+		set: func(c *Config, v string) (err error) { c.Delivery.DomainRates, err = parseDomainRates(v); return }},
+	{env: "SMTP_RETRY_SCHEDULE", flag: "retry-schedule", usage: `delays between retries, as "1m,5m,30m"`,
+		set: func(c *Config, v string) (err error) { c.Delivery.RetrySchedule, err = parseDurations(v); return }},
+	{env: "SMTP_MAX_RETRIES", flag: "max-retries", usage: "retries before a delivery is given up",
+		set: func(c *Config, v string) (err error) { c.Delivery.MaxRetries, err = strconv.Atoi(v); return }},
+	{env: "SMTP_MAX_QUEUE_AGE", flag: "max-queue-age", usage: "how long a message may stay queued",
+		set: durationSetter(func(c *Config) *time.Duration { return &c.Delivery.MaxQueueAge })},
+	{env: "SMTP_DELAY_WARNING", flag: "delay-warning", usage: "queue time before the sender is warned, 0 to disable",
+		set: durationSetter(func(c *Config) *time.Duration { return &c.Delivery.DelayWarning })},
+	{env: "SMTP_TLS_POLICY", flag: "tls-policy", usage: `outbound TLS policies, as "domain=verify,..."`,
+		set: func(c *Config, v string) (err error) { c.Delivery.TLSPolicies, err = parsePairs(v); return }},
+	{env: "SMTP_DNS_SERVERS", flag: "dns-servers", usage: "comma separated DNS servers for MX lookups",
+		set: func(c *Config, v string) error { c.Delivery.DNSServers = splitList(v); return nil }},
+}
+
+func durationSetter(field func(*Config) *time.Duration) func(*Config, string) error {
+	return func(c *Config, v string) (err error) {
+		*field(c), err = time.ParseDuration(v)
+		return
+	}
+}
+
+// extSetting switches the ESMTP extension name with SMTP_EXT_<name> and
+// -ext-<name>.
+func extSetting(name string, field func(*Config) *bool) setting {
+	return setting{
+		env:    "SMTP_EXT_" + name,
+		flag:   "ext-" + strings.ToLower(name),
+		usage:  "offer the " + name + " extension",
+		isBool: true,
+		set: func(c *Config, v string) (err error) {
+			*field(c), err = strconv.ParseBool(v)
+			return
+		},
+	}
+}
+
+// applyEnv overrides c with the settings present in the environment.
+func (c *Config) applyEnv() error {
+	for _, s := range settings {
+		v, ok := os.LookupEnv(s.env)
+		if !ok || v == "" {
+			continue
+		}
+		if err := s.set(c, v); err != nil {
+			return fmt.Errorf("%s: %w", s.env, err)
+		}
+	}
+
+	return nil
+}
+
+// Flags are the command-line options shared by both binaries.
+type Flags struct {
+	// Path is the configuration file, from -config or SMTP_CONFIG.
+	Path string
+	// Check asks for the configuration to be validated without starting.
+	Check bool
+
+	values map[string]string
+}
+
+// RegisterFlags defines -config, -check-config and a flag for every
+// setting on fs.
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	f := &Flags{values: make(map[string]string)}
+	fs.StringVar(&f.Path, "config", os.Getenv("SMTP_CONFIG"), "configuration file (.yaml or .toml)")
+	fs.BoolVar(&f.Check, "check-config", false, "validate the configuration and exit")
+	for _, s := range settings {
+		fs.Var(&flagValue{f.values, s.flag, s.isBool}, s.flag, s.usage+" ($"+s.env+")")
+	}
+
+	return f
+}
+
+// Load loads the configuration file and environment, applies the flags
+// given on the command line and validates the result. It can be called
+// again to reload.
+func (f *Flags) Load() (*Config, error) {
+	c, err := load(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range settings {
+		v, ok := f.values[s.flag]
+		if !ok {
+			continue
+		}
+		if err := s.set(c, v); err != nil {
+			return nil, fmt.Errorf("-%s: %w", s.flag, err)
+		}
+	}
+	if err := c.finish(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// FromCommandLine parses the command line and loads the configuration.
+// With -check-config it reports the outcome and exits; otherwise a bad
+// configuration ends the process.
+func FromCommandLine() (*Config, *Flags) {
+	f := RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	c, err := f.Load()
+	if f.Check {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("configuration ok")
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid configuration:", err)
+		os.Exit(1)
+	}
+
+	return c, f
+}
+
+// flagValue records a flag's raw value, applied by Flags.Load after the
+// file and environment.
+type flagValue struct {
+	values map[string]string
+	name   string
+	isBool bool
+}
+
+func (v *flagValue) String() string {
+	if v == nil || v.values == nil {
+		return ""
+	}
+	return v.values[v.name]
+}
+
+func (v *flagValue) Set(s string) error {
+	v.values[v.name] = s
+	return nil
+}
+
+func (v *flagValue) IsBoolFlag() bool { return v.isBool }
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// parsePairs reads "key=value" pairs separated by commas.
+func parsePairs(s string) (map[string]string, error) {
+	pairs := make(map[string]string)
+	for _, pair := range splitList(s) {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("bad pair %q, want key=value", pair)
+		}
+		pairs[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+
+	return pairs, nil
+}
+
+// parseDomainRates reads "domain=messages-per-minute" pairs separated by
+// commas, with "*" as the default for other domains.
+func parseDomainRates(s string) (map[string]int, error) {
+	pairs, err := parsePairs(s)
+	if err != nil {
+		return nil, err
+	}
+	rates := make(map[string]int, len(pairs))
+	for domain, value := range pairs {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("bad rate %q for %s", value, domain)
+		}
+		rates[domain] = n
+	}
+
+	return rates, nil
+}
+
+// parseDurations reads a comma separated list of durations such as
+// "1m,5m,30m,2h".
+func parseDurations(s string) ([]time.Duration, error) {
+	var list []time.Duration
+	for _, field := range splitList(s) {
+		d, err := time.ParseDuration(field)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, d)
+	}
+
+	return list, nil
+}
@@ -2,27 +2,16 @@ package db
 
 import (
 	"context"
-	"os"
 
 	"github.com/redis/go-redis/v9"
 )
 
-func ConnectRedis() (*redis.Client, error) {
-	redisURL := os.Getenv("REDIS_URL")
-	var opts *redis.Options
-	var err error
-
-	if redisURL != "" {
-		opts, err = redis.ParseURL(redisURL)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		opts = &redis.Options{
-			Addr:     "localhost:6379",
-			Password: "",
-			DB:       0,
-		}
+// ConnectRedis connects to the Redis server at redisURL and checks that it
+// answers.
+func ConnectRedis(redisURL string) (*redis.Client, error) {
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, err
 	}
 
 	client := redis.NewClient(opts)
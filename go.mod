@@ -2,12 +2,23 @@ module smtp-server
 
 go 1.25.0
 
-require github.com/redis/go-redis/v9 v9.17.3
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/miekg/dns v1.1.72
+	github.com/redis/go-redis/v9 v9.17.3
+	github.com/sony/sonyflake/v2 v2.2.0
+	go.yaml.in/yaml/v3 v3.0.5
+	golang.org/x/crypto v0.47.0
+	golang.org/x/net v0.48.0
+	golang.org/x/text v0.33.0
+)
 
 require (
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/sony/sonyflake v1.3.0 // indirect
-	github.com/sony/sonyflake/v2 v2.2.0 // indirect
-	golang.org/x/crypto v0.47.0 // indirect
+	golang.org/x/mod v0.31.0 // indirect
+	golang.org/x/sync v0.19.0 // indirect
+	golang.org/x/sys v0.40.0 // indirect
+	golang.org/x/tools v0.40.0 // indirect
 )
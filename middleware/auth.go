@@ -3,13 +3,16 @@ package middleware
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
 type Auth struct {
-	rdb          *redis.Client
+	rdb *redis.Client
+
+	mu           sync.RWMutex
 	failLimit    int
 	lockDuration time.Duration
 }
@@ -22,6 +25,22 @@ func SetupAuth(rdb *redis.Client, l int, d time.Duration) *Auth {
 	}
 }
 
+// SetLimits changes the lockout settings of a running server.
+func (a *Auth) SetLimits(l int, d time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.failLimit = l
+	a.lockDuration = d
+}
+
+func (a *Auth) limits() (int, time.Duration) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.failLimit, a.lockDuration
+}
+
 func (a *Auth) IncreaseFails(username string) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(3*time.Second))
 	defer cancel()
@@ -33,15 +52,15 @@ func (a *Auth) IncreaseFails(username string) {
 	if fails == 1 {
 		a.rdb.Expire(ctx, failKey, 10*time.Minute)
 	}
-	if fails < 5 {
+	limit, d := a.limits()
+	if fails < int64(limit) {
 		return
 	}
 
 	lockKey := fmt.Sprintf("lock:user:%s", username)
-	d := a.lockDuration
-	if fails >= 15 {
+	if fails >= int64(3*limit) {
 		d *= 6
-	} else if fails >= 10 {
+	} else if fails >= int64(2*limit) {
 		d *= 3
 	}
 
@@ -4,13 +4,16 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
 type RateLimiter struct {
-	rdb       *redis.Client
+	rdb *redis.Client
+
+	mu        sync.RWMutex
 	IPLimit   int64
 	UserLimit int64
 	duration  time.Duration
@@ -25,6 +28,17 @@ func NewRateLimit(rdb *redis.Client, ip, user int64, d time.Duration) *RateLimit
 	}
 }
 
+// SetLimits changes the limits of a running server. Counters already
+// running keep the window they started with.
+func (r *RateLimiter) SetLimits(ip, user int64, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.IPLimit = ip
+	r.UserLimit = user
+	r.duration = d
+}
+
 func (r *RateLimiter) Validate(userName string, ip net.IP) bool {
 	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(5*time.Second))
 	defer cancel()
@@ -32,15 +46,19 @@ func (r *RateLimiter) Validate(userName string, ip net.IP) bool {
 	ipKey := fmt.Sprintf("auth:ip:%s", ip)
 	userKey := fmt.Sprintf("auth:user:%s", userName)
 
+	r.mu.RLock()
+	ipLimit, userLimit, d := r.IPLimit, r.UserLimit, r.duration
+	r.mu.RUnlock()
+
 	ipCount, _ := r.rdb.Incr(ctx, ipKey).Result()
 	userCount, _ := r.rdb.Incr(ctx, userKey).Result()
 
 	if ipCount == 1 {
-		r.rdb.Expire(ctx, ipKey, r.duration)
+		r.rdb.Expire(ctx, ipKey, d)
 	}
 	if userCount == 1 {
-		r.rdb.Expire(ctx, userKey, r.duration)
+		r.rdb.Expire(ctx, userKey, d)
 	}
 
-	return !(ipCount > r.IPLimit || userCount > r.UserLimit)
+	return !(ipCount > ipLimit || userCount > userLimit)
 }
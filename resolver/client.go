@@ -0,0 +1,266 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Client queries upstream recursive servers directly and caches every
+// answer for as long as its TTL allows. NXDOMAIN and empty answers are
+// cached as well, for the SOA minimum of the zone (RFC 2308).
+type Client struct {
+	// Servers are tried in order, as host:port.
+	Servers []string
+	// MaxTTL caps how long any answer is cached.
+	MaxTTL time.Duration
+	// NegativeTTL is used for negative answers that carry no SOA, and
+	// caps the ones that do.
+	NegativeTTL time.Duration
+	// MaxEntries caps the number of cached answers. When the cache is
+	// full, expired answers are dropped first, then arbitrary ones.
+	MaxEntries int
+
+	udp *dns.Client
+	tcp *dns.Client
+
+	mu    sync.Mutex
+	cache map[cacheKey]cacheEntry
+}
+
+type cacheKey struct {
+	qtype uint16
+	name  string
+}
+
+type cacheEntry struct {
+	rrs     []dns.RR
+	err     error
+	expires time.Time
+}
+
+func NewClient(servers []string) *Client {
+	return &Client{
+		Servers:     servers,
+		MaxTTL:      24 * time.Hour,
+		NegativeTTL: 5 * time.Minute,
+		MaxEntries:  10000,
+		udp:         &dns.Client{Net: "udp", Timeout: 5 * time.Second},
+		tcp:         &dns.Client{Net: "tcp", Timeout: 5 * time.Second},
+		cache:       make(map[cacheKey]cacheEntry),
+	}
+}
+
+// NewClientFromResolvConf uses the name servers listed in a resolv.conf
+// style file, usually /etc/resolv.conf.
+func NewClientFromResolvConf(path string) (*Client, error) {
+	conf, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	servers := make([]string, 0, len(conf.Servers))
+	for _, s := range conf.Servers {
+		servers = append(servers, net.JoinHostPort(s, conf.Port))
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no name servers in %s", path)
+	}
+
+	return NewClient(servers), nil
+}
+
+func (c *Client) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	rrs, err := c.query(ctx, name, dns.TypeMX)
+	if err != nil {
+		return nil, err
+	}
+
+	mx := make([]*net.MX, 0, len(rrs))
+	for _, rr := range rrs {
+		r := rr.(*dns.MX)
+		mx = append(mx, &net.MX{Host: r.Mx, Pref: r.Preference})
+	}
+	return mx, nil
+}
+
+// LookupIPAddr returns both IPv4 and IPv6 addresses and only reports the
+// host as not found if it has neither.
+func (c *Client) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+
+	var addrs []net.IPAddr
+	var firstErr error
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		rrs, err := c.query(ctx, host, qtype)
+		if err != nil {
+			if firstErr == nil || IsNotFound(firstErr) {
+				firstErr = err
+			}
+			continue
+		}
+		for _, rr := range rrs {
+			switch r := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, net.IPAddr{IP: r.A})
+			case *dns.AAAA:
+				addrs = append(addrs, net.IPAddr{IP: r.AAAA})
+			}
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, firstErr
+	}
+	return addrs, nil
+}
+
+func (c *Client) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	rrs, err := c.query(ctx, name, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+
+	txt := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		txt = append(txt, strings.Join(rr.(*dns.TXT).Txt, ""))
+	}
+	return txt, nil
+}
+
+func (c *Client) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	arpa, err := dns.ReverseAddr(addr)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: addr}
+	}
+
+	rrs, err := c.query(ctx, arpa, dns.TypePTR)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		names = append(names, rr.(*dns.PTR).Ptr)
+	}
+	return names, nil
+}
+
+// query returns the records of qtype for name, from the cache if an
+// unexpired answer is there. Only records of qtype are returned, so CNAME
+// chains in the answer section are skipped.
+func (c *Client) query(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	key := cacheKey{qtype: qtype, name: dns.Fqdn(strings.ToLower(name))}
+	if e, ok := c.cached(key); ok {
+		return e.rrs, e.err
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(key.name, qtype)
+	req.SetEdns0(4096, false)
+
+	lastErr := fmt.Errorf("no name servers configured")
+	for _, server := range c.Servers {
+		resp, _, err := c.udp.ExchangeContext(ctx, req, server)
+		if err == nil && resp.Truncated {
+			resp, _, err = c.tcp.ExchangeContext(ctx, req, server)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		switch resp.Rcode {
+		case dns.RcodeSuccess:
+			var rrs []dns.RR
+			ttl := c.MaxTTL
+			for _, rr := range resp.Answer {
+				if rr.Header().Rrtype != qtype {
+					continue
+				}
+				rrs = append(rrs, rr)
+				ttl = min(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+			}
+			if len(rrs) == 0 {
+				err := notFound(name)
+				c.store(key, nil, err, c.negativeTTL(resp))
+				return nil, err
+			}
+			c.store(key, rrs, nil, ttl)
+			return rrs, nil
+		case dns.RcodeNameError:
+			err := notFound(name)
+			c.store(key, nil, err, c.negativeTTL(resp))
+			return nil, err
+		default:
+			lastErr = fmt.Errorf("%s from %s", dns.RcodeToString[resp.Rcode], server)
+		}
+	}
+
+	return nil, &net.DNSError{Err: lastErr.Error(), Name: name, IsTemporary: true}
+}
+
+// negativeTTL derives the negative caching time from the SOA record in the
+// authority section, capped at NegativeTTL.
+func (c *Client) negativeTTL(resp *dns.Msg) time.Duration {
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := time.Duration(min(soa.Hdr.Ttl, soa.Minttl)) * time.Second
+			return min(ttl, c.NegativeTTL)
+		}
+	}
+	return c.NegativeTTL
+}
+
+func (c *Client) cached(key cacheKey) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.cache[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.cache, key)
+		return cacheEntry{}, false
+	}
+	return e, true
+}
+
+func (c *Client) store(key cacheKey, rrs []dns.RR, err error, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.cache[key]; !ok && c.MaxEntries > 0 && len(c.cache) >= c.MaxEntries {
+		c.evict()
+	}
+	c.cache[key] = cacheEntry{rrs: rrs, err: err, expires: time.Now().Add(ttl)}
+}
+
+// evict makes room for one more entry: it drops every expired answer, and
+// if that frees nothing, as many others as needed. Map order is random, so
+// no name is favoured. c.mu must be held.
+func (c *Client) evict() {
+	now := time.Now()
+	for key, e := range c.cache {
+		if now.After(e.expires) {
+			delete(c.cache, key)
+		}
+	}
+	for key := range c.cache {
+		if len(c.cache) < c.MaxEntries {
+			break
+		}
+		delete(c.cache, key)
+	}
+}
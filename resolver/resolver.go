@@ -0,0 +1,98 @@
+// Package resolver provides the DNS lookups the mail server depends on,
+// behind an interface so they can be cached, pointed at specific upstream
+// servers or replaced by fixed answers in tests.
+package resolver
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Resolver is the subset of *net.Resolver the server uses, so
+// net.DefaultResolver is a valid implementation.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+var _ Resolver = net.DefaultResolver
+
+var (
+	// ErrNullMX is returned for domains that publish "MX 0 ." (RFC 7505).
+	ErrNullMX = errors.New("domain does not accept mail")
+	// ErrNoSuchDomain is returned when a domain has neither MX nor address
+	// records.
+	ErrNoSuchDomain = errors.New("domain has no MX or address records")
+)
+
+// MXHosts returns the hosts to try for domain, most preferred first, with
+// hosts of equal preference in random order to spread the load. Without
+// MX records the domain itself is used as implicit MX, as RFC 5321 5.1
+// requires.
+func MXHosts(ctx context.Context, r Resolver, domain string) ([]string, error) {
+	mxRecords, err := r.LookupMX(ctx, domain)
+	if IsNotFound(err) || (err == nil && len(mxRecords) == 0) {
+		return implicitMX(ctx, r, domain)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(mxRecords) == 1 && (mxRecords[0].Host == "." || mxRecords[0].Host == "") {
+		return nil, ErrNullMX
+	}
+
+	// The records may be the resolver's own, as with Static; reorder a
+	// copy.
+	mxRecords = slices.Clone(mxRecords)
+	rand.Shuffle(len(mxRecords), func(i, j int) {
+		mxRecords[i], mxRecords[j] = mxRecords[j], mxRecords[i]
+	})
+	sort.SliceStable(mxRecords, func(i, j int) bool {
+		return mxRecords[i].Pref < mxRecords[j].Pref
+	})
+
+	hosts := make([]string, 0, len(mxRecords))
+	for _, mx := range mxRecords {
+		if host := strings.TrimSuffix(mx.Host, "."); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+
+	return hosts, nil
+}
+
+// implicitMX falls back to the domain's own A/AAAA records.
+func implicitMX(ctx context.Context, r Resolver, domain string) ([]string, error) {
+	addrs, err := r.LookupIPAddr(ctx, domain)
+	if IsNotFound(err) || (err == nil && len(addrs) == 0) {
+		return nil, ErrNoSuchDomain
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return []string{domain}, nil
+}
+
+// IsNotFound reports whether err says the name or record does not exist,
+// as opposed to a lookup failure worth retrying.
+func IsNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// normalize lower-cases name and strips the root dot.
+func normalize(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
@@ -0,0 +1,47 @@
+package resolver
+
+import (
+	"context"
+	"net"
+)
+
+// Static answers from fixed tables, for tests and offline setups. Names
+// are matched case-insensitively and without the trailing dot; anything
+// missing is reported as not found.
+type Static struct {
+	MX  map[string][]*net.MX
+	IP  map[string][]net.IPAddr
+	TXT map[string][]string
+	PTR map[string][]string
+}
+
+func (s *Static) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if mx, ok := s.MX[normalize(name)]; ok {
+		return mx, nil
+	}
+	return nil, notFound(name)
+}
+
+func (s *Static) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	if addrs, ok := s.IP[normalize(host)]; ok {
+		return addrs, nil
+	}
+	return nil, notFound(host)
+}
+
+func (s *Static) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txt, ok := s.TXT[normalize(name)]; ok {
+		return txt, nil
+	}
+	return nil, notFound(name)
+}
+
+func (s *Static) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if names, ok := s.PTR[addr]; ok {
+		return names, nil
+	}
+	return nil, notFound(addr)
+}
@@ -0,0 +1,283 @@
+package smtp
+
+import (
+	"net"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	errPathSyntax = &SMTPError{Code: 501, EnhancedCode: EnhancedCode{5, 5, 4}, Message: "Syntax error in path, expected <address>"}
+	errNullPath   = &SMTPError{Code: 501, EnhancedCode: EnhancedCode{5, 1, 3}, Message: "Null path not allowed here"}
+	errNonASCII   = &SMTPError{Code: 553, EnhancedCode: EnhancedCode{5, 6, 7}, Message: "Non-ASCII address not permitted"}
+)
+
+// Length limits from RFC 5321 section 4.5.3.1.
+const (
+	maxLocalPart = 64
+	maxDomain    = 255
+	maxPath      = 256
+)
+
+// badAddress is the 553 reply for a path that is well-formed as a command
+// but does not hold a valid mailbox.
+func badAddress(forward bool, reason string) *SMTPError {
+	code := EnhancedCode{5, 1, 7}
+	if forward {
+		code = EnhancedCode{5, 1, 3}
+	}
+	return &SMTPError{Code: 553, EnhancedCode: code, Message: reason}
+}
+
+// ParseAddress checks a mailbox the way RCPT TO does in an SMTPUTF8
+// transaction, and returns it in the form the server hands the backend,
+// so addresses stored elsewhere can be matched against the envelope.
+func ParseAddress(address string) (string, error) {
+	return parseMailbox(address, true, true)
+}
+
+// parseReversePath validates the path of MAIL FROM. The null path "<>"
+// is returned as an empty string. A UTF-8 address needs smtputf8.
+func parseReversePath(path string, smtputf8 bool) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	return parseMailbox(path, false, smtputf8)
+}
+
+// Postmaster is the recipient handed to Session.Rcpt for the bare
+// <Postmaster> that every server must accept (RFC 5321 section 4.1.1.3).
+// It has no domain; the backend decides which mailbox it stands for.
+const Postmaster = "Postmaster"
+
+// parseForwardPath validates the path of RCPT TO. The bare "Postmaster",
+// in any case, is returned as Postmaster.
+func parseForwardPath(path string, smtputf8 bool) (string, error) {
+	if path == "" {
+		return "", errNullPath
+	}
+	if strings.EqualFold(path, Postmaster) {
+		return Postmaster, nil
+	}
+	return parseMailbox(path, true, smtputf8)
+}
+
+// parseMailbox checks a path without its angle brackets and returns the
+// mailbox. A source route is dropped, as RFC 5321 section 4.1.2 requires,
+// a quoted local part that needs no quoting is unquoted, and an
+// internationalised domain is converted to its ASCII form so it can be
+// looked up. UTF-8 in the local part or the domain (RFC 6531) is only
+// allowed with smtputf8; a local part is brought to Unicode normalization
+// form C.
+func parseMailbox(path string, forward, smtputf8 bool) (string, error) {
+	if len(path) > maxPath {
+		return "", badAddress(forward, "Path too long")
+	}
+
+	if strings.HasPrefix(path, "@") {
+		route, rest, ok := strings.Cut(path, ":")
+		if !ok {
+			return "", badAddress(forward, "Malformed source route")
+		}
+		for _, hop := range strings.Split(route, ",") {
+			if !strings.HasPrefix(hop, "@") || !validDomain(hop[1:]) {
+				return "", badAddress(forward, "Malformed source route")
+			}
+		}
+		path = rest
+	}
+
+	local, domain, err := splitMailbox(path, forward, smtputf8)
+	if err != nil {
+		return "", err
+	}
+
+	if strings.HasPrefix(domain, "[") {
+		if !validAddressLiteral(domain) {
+			return "", badAddress(forward, "Invalid address literal "+domain)
+		}
+	} else {
+		if !IsASCII(domain) && !smtputf8 {
+			return "", errNonASCII
+		}
+		ascii, ok := domainToASCII(domain)
+		if !ok {
+			return "", badAddress(forward, "Invalid domain "+domain)
+		}
+		domain = ascii
+	}
+
+	return local + "@" + domain, nil
+}
+
+// splitMailbox separates and checks the local part.
+func splitMailbox(mailbox string, forward, smtputf8 bool) (string, string, error) {
+	var local, rest string
+	if strings.HasPrefix(mailbox, `"`) {
+		end, ok := quotedEnd(mailbox)
+		if !ok {
+			return "", "", badAddress(forward, "Unterminated quoted local part")
+		}
+		local, rest = mailbox[:end], mailbox[end:]
+		if !IsASCII(local) && !smtputf8 {
+			return "", "", errNonASCII
+		}
+		content, ok := unquote(local)
+		if !ok {
+			return "", "", badAddress(forward, "Invalid character in quoted local part")
+		}
+		if validDotString(content) {
+			local = content
+		}
+	} else {
+		i := strings.IndexByte(mailbox, '@')
+		if i < 0 {
+			return "", "", badAddress(forward, "Address must include a domain")
+		}
+		local, rest = mailbox[:i], mailbox[i:]
+		if !IsASCII(local) && !smtputf8 {
+			return "", "", errNonASCII
+		}
+		if !validDotString(local) {
+			return "", "", badAddress(forward, "Invalid local part "+local)
+		}
+	}
+	if !IsASCII(local) {
+		local = norm.NFC.String(local)
+	}
+
+	if !strings.HasPrefix(rest, "@") || len(rest) == 1 {
+		return "", "", badAddress(forward, "Address must include a domain")
+	}
+	if len(local) > maxLocalPart {
+		return "", "", badAddress(forward, "Local part too long")
+	}
+
+	return local, rest[1:], nil
+}
+
+// quotedEnd returns the index just past the closing quote of the quoted
+// string s starts with.
+func quotedEnd(s string) (int, bool) {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+// unquote returns the content of a quoted string, checking it against
+// qtextSMTP and quoted-pairSMTP. Bytes of UTF-8 characters are let
+// through; whether they are allowed at all is up to the caller.
+func unquote(q string) (string, bool) {
+	if !utf8.ValidString(q) {
+		return "", false
+	}
+	var b strings.Builder
+	for i := 1; i < len(q)-1; i++ {
+		c := q[i]
+		if c == '\\' {
+			i++
+			c = q[i]
+			if c < 32 || c > 126 {
+				return "", false
+			}
+		} else if c < 32 || c == 127 || c == '"' {
+			return "", false
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), true
+}
+
+// validDotString reports whether s is atoms separated by single dots.
+// Like RFC 6531, it counts any UTF-8 character beyond ASCII as atext.
+func validDotString(s string) bool {
+	if s == "" || !utf8.ValidString(s) {
+		return false
+	}
+	for _, atom := range strings.Split(s, ".") {
+		if atom == "" {
+			return false
+		}
+		for i := 0; i < len(atom); i++ {
+			if !isAtext(atom[i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func isAtext(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c >= 0x80:
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-/=?^_`{|}~", c) >= 0
+}
+
+// IsASCII reports whether s has no bytes outside US-ASCII.
+func IsASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// domainToASCII validates a domain and returns it with any U-labels
+// converted to A-labels.
+func domainToASCII(domain string) (string, bool) {
+	if !IsASCII(domain) {
+		ascii, err := idna.Lookup.ToASCII(domain)
+		if err != nil {
+			return "", false
+		}
+		domain = ascii
+	}
+	return domain, validDomain(domain)
+}
+
+// validDomain checks the sub-domain syntax of RFC 5321: letters, digits
+// and inner hyphens, labels of at most 63 octets.
+func validDomain(domain string) bool {
+	if domain == "" || len(domain) > maxDomain {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// validAddressLiteral accepts the IPv4 and IPv6 forms of an address
+// literal such as "[192.0.2.1]" or "[IPv6:2001:db8::1]".
+func validAddressLiteral(lit string) bool {
+	if !strings.HasSuffix(lit, "]") {
+		return false
+	}
+	inner := lit[1 : len(lit)-1]
+	if v6, ok := cutPrefixFold(inner, "IPv6:"); ok {
+		ip := net.ParseIP(v6)
+		return ip != nil && ip.To4() == nil
+	}
+	ip := net.ParseIP(inner)
+	return ip != nil && ip.To4() != nil && !strings.Contains(inner, ":")
+}
@@ -0,0 +1,33 @@
+package smtp
+
+import "io"
+
+// Backend creates the Session that backs a single client connection.
+type Backend interface {
+	NewSession(c *Conn) (Session, error)
+}
+
+// Session is the storage side of an SMTP connection. The protocol engine
+// calls it in command order and writes any returned error back to the
+// client; an *SMTPError is sent as is, anything else becomes a local error.
+type Session interface {
+	// Auth verifies the credentials presented with AUTH.
+	Auth(username, password string) error
+	// Mail starts a new transaction with the given reverse-path.
+	Mail(from string, opts *MailOptions) error
+	// Rcpt adds a forward-path to the current transaction. The bare
+	// <Postmaster> arrives as Postmaster and should always be accepted.
+	Rcpt(to string, opts *RcptOptions) error
+	// Data receives the message content of the current transaction.
+	Data(r io.Reader) error
+	// Reset discards the current transaction.
+	Reset()
+	// Logout is called once the connection is closed.
+	Logout() error
+}
+
+// AuthLimiter may be implemented by a Session to refuse an AUTH attempt as
+// soon as the client names the user, before any password is requested.
+type AuthLimiter interface {
+	AuthAllowed(username string) error
+}
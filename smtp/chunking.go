@@ -0,0 +1,334 @@
+package smtp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BodyType is the BODY parameter of MAIL, which declares what the message
+// content may contain.
+type BodyType string
+
+const (
+	Body7Bit BodyType = "7BIT"
+	// Body8BitMIME content may hold octets above 127 in lines of the
+	// usual length (RFC 6152).
+	Body8BitMIME BodyType = "8BITMIME"
+	// BodyBinaryMIME content may hold any octet and lines of any length,
+	// so it can only be transferred with BDAT (RFC 3030).
+	BodyBinaryMIME BodyType = "BINARYMIME"
+)
+
+var (
+	errBdatSyntax  = &SMTPError{Code: 501, EnhancedCode: EnhancedCode{5, 5, 4}, Message: "Syntax: BDAT size [LAST]"}
+	errBinaryData  = &SMTPError{Code: 503, EnhancedCode: EnhancedCode{5, 5, 1}, Message: "BINARYMIME messages must be sent with BDAT"}
+	errBdatAborted = errors.New("smtp: BDAT transfer aborted")
+	errBdatStopped = errors.New("smtp: backend stopped reading the message")
+)
+
+// bdatTransfer is a message arriving in BDAT chunks. The chunks are piped
+// into Session.Data, which runs alongside the session for as long as the
+// transfer lasts.
+type bdatTransfer struct {
+	pw   *io.PipeWriter
+	done chan error
+	size int64
+
+	over bool
+	err  error
+}
+
+func (c *Conn) startBdat() *bdatTransfer {
+	pr, pw := io.Pipe()
+	t := &bdatTransfer{pw: pw, done: make(chan error, 1)}
+	session := c.session
+	go func() {
+		err := session.Data(pr)
+		// Chunks the backend did not read are thrown away rather than
+		// blocking the session.
+		pr.CloseWithError(errBdatStopped)
+		t.done <- err
+	}()
+
+	return t
+}
+
+// finished reports whether the backend is already done with the message,
+// and its result if so.
+func (t *bdatTransfer) finished() (bool, error) {
+	if !t.over {
+		select {
+		case t.err = <-t.done:
+			t.over = true
+		default:
+		}
+	}
+	return t.over, t.err
+}
+
+// wait returns the result of the backend once it is done.
+func (t *bdatTransfer) wait() error {
+	if !t.over {
+		t.err = <-t.done
+		t.over = true
+	}
+	return t.err
+}
+
+// abortBdat ends a transfer in progress without a message, so the backend
+// sees an error instead of content.
+func (c *Conn) abortBdat() {
+	if c.bdat == nil {
+		return
+	}
+	c.bdat.pw.CloseWithError(errBdatAborted)
+	c.bdat.wait()
+	c.bdat = nil
+}
+
+// parseBdat parses the argument of BDAT.
+func parseBdat(arg string) (int64, bool, error) {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 || len(fields) > 2 {
+		return 0, false, errBdatSyntax
+	}
+	for _, r := range fields[0] {
+		if r < '0' || r > '9' {
+			return 0, false, errBdatSyntax
+		}
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, false, errBdatSyntax
+	}
+	last := len(fields) == 2
+	if last && !strings.EqualFold(fields[1], "LAST") {
+		return 0, false, errBdatSyntax
+	}
+
+	return size, last, nil
+}
+
+// handleBdat receives one chunk of a message (RFC 3030). The chunk follows
+// the command whatever the reply will be, so a refused chunk is still read
+// and thrown away to stay in step with the client. It reports whether the
+// connection is still usable.
+func (c *Conn) handleBdat(arg string) bool {
+	size, last, err := parseBdat(arg)
+	if err != nil {
+		// Without a size there is no telling where the next command starts.
+		c.writeError(err, nil)
+		return false
+	}
+
+	c.in.expect(c.server.Timeouts.DataBlock, c.server.Timeouts.DataTermination)
+
+	var refusal error
+	switch {
+	case !c.esmtp:
+		refusal = ErrBadSequence
+	case c.server.AuthRequired && !c.authenticated:
+		refusal = ErrAuthRequired
+	case c.bdat == nil && c.state != stateRcpt:
+		refusal = ErrBadSequence
+	}
+	if refusal == nil {
+		if _, max := c.server.messageLimits(); max > 0 && c.bdatSize()+size > max {
+			refusal = ErrDataTooLarge
+		}
+	}
+	if refusal != nil {
+		if _, err := io.CopyN(io.Discard, c.reader, size); err != nil {
+			c.readFailed(err)
+			return false
+		}
+		if refusal == ErrDataTooLarge {
+			c.reset()
+		}
+		c.writeError(refusal, nil)
+		return true
+	}
+
+	if c.bdat == nil {
+		c.bdat = c.startBdat()
+		c.state = stateData
+	}
+	t := c.bdat
+	t.size += size
+
+	sink := &discardOnError{w: t.pw}
+	if _, err := io.CopyN(sink, c.reader, size); err != nil {
+		c.readFailed(err)
+		return false
+	}
+
+	if !last {
+		if over, err := t.finished(); over && err != nil {
+			c.writeError(err, ErrLocal)
+			c.reset()
+			return true
+		}
+		c.writeResponse(250, EnhancedCode{2, 0, 0}, strconv.FormatInt(size, 10)+" octets received")
+		return true
+	}
+
+	t.pw.Close()
+	err = t.wait()
+	c.bdat = nil
+	if err != nil {
+		c.writeError(err, ErrLocal)
+	} else {
+		c.writeResponse(250, EnhancedCode{2, 0, 0}, "Message accepted")
+	}
+	c.reset()
+	return true
+}
+
+func (c *Conn) bdatSize() int64 {
+	if c.bdat == nil {
+		return 0
+	}
+	return c.bdat.size
+}
+
+// discardOnError passes writes on to w until w fails, and from then on
+// swallows them, so the rest of a chunk can still be read off the wire.
+type discardOnError struct {
+	w   io.Writer
+	err error
+}
+
+func (d *discardOnError) Write(p []byte) (int, error) {
+	if d.err == nil {
+		_, d.err = d.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// bdatChunkSize is how much of a message the client sends per BDAT.
+const bdatChunkSize = 1 << 20
+
+// bdat sends r in BDAT chunks. Text content gets CRLF line endings, as
+// with DATA; BINARYMIME content is sent as it is.
+func (c *Client) bdat(r io.Reader) (string, error) {
+	w := &bdatWriter{c: c, buf: make([]byte, 0, bdatChunkSize)}
+	if c.body == BodyBinaryMIME {
+		if _, err := io.Copy(w, r); err != nil {
+			return "", err
+		}
+		return w.close()
+	}
+
+	crlf := &crlfWriter{w: w}
+	if _, err := io.Copy(crlf, r); err != nil {
+		return "", err
+	}
+	if err := crlf.close(); err != nil {
+		return "", err
+	}
+	return w.close()
+}
+
+// bdatWriter sends everything written to it as BDAT chunks of
+// bdatChunkSize; close sends the rest with LAST.
+type bdatWriter struct {
+	c   *Client
+	buf []byte
+}
+
+func (w *bdatWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		m := min(len(p), bdatChunkSize-len(w.buf))
+		w.buf = append(w.buf, p[:m]...)
+		p = p[m:]
+		if len(w.buf) == bdatChunkSize {
+			if _, err := w.send(false); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+func (w *bdatWriter) close() (string, error) {
+	return w.send(true)
+}
+
+func (w *bdatWriter) send(last bool) (string, error) {
+	c := w.c
+	c.conn.SetDeadline(time.Now().Add(c.timeouts.DataBlock))
+
+	cmd := "BDAT " + strconv.Itoa(len(w.buf))
+	timeout := c.timeouts.DataBlock
+	if last {
+		cmd += " LAST"
+		timeout = c.timeouts.DataEnd
+	}
+	bw := c.text.Writer.W
+	bw.WriteString(cmd + "\r\n")
+	bw.Write(w.buf)
+	if err := bw.Flush(); err != nil {
+		return "", err
+	}
+	w.buf = w.buf[:0]
+
+	return c.readReply(timeout, 250)
+}
+
+// crlfWriter turns bare LF line endings into CRLF, and close ends the
+// content with CRLF if it does not already.
+type crlfWriter struct {
+	w      io.Writer
+	prevCR bool
+	last   byte
+}
+
+func (w *crlfWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			break
+		}
+		if (i > 0 && p[i-1] == '\r') || (i == 0 && w.prevCR) {
+			if _, err := w.w.Write(p[:i+1]); err != nil {
+				return 0, err
+			}
+		} else {
+			if _, err := w.w.Write(p[:i]); err != nil {
+				return 0, err
+			}
+			if _, err := w.w.Write([]byte("\r\n")); err != nil {
+				return 0, err
+			}
+		}
+		w.prevCR, w.last = false, '\n'
+		p = p[i+1:]
+	}
+	if len(p) > 0 {
+		if _, err := w.w.Write(p); err != nil {
+			return 0, err
+		}
+		w.prevCR, w.last = p[len(p)-1] == '\r', p[len(p)-1]
+	}
+
+	return n, nil
+}
+
+func (w *crlfWriter) close() error {
+	if w.last == 0 || w.last == '\n' {
+		return nil
+	}
+	if w.prevCR {
+		_, err := w.w.Write([]byte("\n"))
+		return err
+	}
+	_, err := w.w.Write([]byte("\r\n"))
+	return err
+}
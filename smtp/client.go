@@ -0,0 +1,318 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ClientTimeouts bounds every stage of an outbound transaction. The
+// defaults follow RFC 5321 section 4.5.3.2.
+type ClientTimeouts struct {
+	Connect   time.Duration
+	Greeting  time.Duration
+	Mail      time.Duration
+	Rcpt      time.Duration
+	DataStart time.Duration
+	DataBlock time.Duration
+	DataEnd   time.Duration
+}
+
+var DefaultClientTimeouts = ClientTimeouts{
+	Connect:   30 * time.Second,
+	Greeting:  5 * time.Minute,
+	Mail:      5 * time.Minute,
+	Rcpt:      5 * time.Minute,
+	DataStart: 2 * time.Minute,
+	DataBlock: 3 * time.Minute,
+	DataEnd:   10 * time.Minute,
+}
+
+// Client is an outbound SMTP connection to another MTA. Every method that
+// gets a reply returns it as an *SMTPError when it is not a success, so
+// callers can tell 4xx from 5xx with Temporary.
+type Client struct {
+	conn     net.Conn
+	text     *textproto.Conn
+	timeouts ClientTimeouts
+	ext      map[string]string
+	hello    string
+	// body is the BODY of the transaction in progress.
+	body BodyType
+}
+
+// Dial connects to addr and reads the greeting.
+func Dial(addr string, timeouts ClientTimeouts) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeouts.Connect)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := NewClient(conn, timeouts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// NewClient wraps an established connection and reads the greeting.
+func NewClient(conn net.Conn, timeouts ClientTimeouts) (*Client, error) {
+	c := &Client{
+		conn:     conn,
+		text:     textproto.NewConn(conn),
+		timeouts: timeouts,
+	}
+
+	if _, err := c.readReply(timeouts.Greeting, 220); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Hello sends EHLO, falling back to HELO for servers that do not speak
+// ESMTP, and records the advertised extensions.
+func (c *Client) Hello(localName string) error {
+	c.hello = localName
+	reply, err := c.cmd(c.timeouts.Greeting, 250, "EHLO %s", localName)
+	if err != nil {
+		if !IsPermanent(err) {
+			return err
+		}
+		c.ext = nil
+		_, err = c.cmd(c.timeouts.Greeting, 250, "HELO %s", localName)
+		return err
+	}
+
+	c.ext = make(map[string]string)
+	lines := strings.Split(reply, "\n")
+	for _, line := range lines[1:] {
+		key, value, _ := strings.Cut(line, " ")
+		c.ext[strings.ToUpper(key)] = value
+	}
+
+	return nil
+}
+
+// Extension reports whether the server advertised name in its EHLO reply,
+// along with the extension's parameters.
+func (c *Client) Extension(name string) (bool, string) {
+	value, ok := c.ext[strings.ToUpper(name)]
+	return ok, value
+}
+
+// StartTLS upgrades the connection and repeats EHLO, since RFC 3207 makes
+// the server forget everything it was told before the handshake.
+func (c *Client) StartTLS(config *tls.Config) error {
+	if _, err := c.cmd(c.timeouts.Greeting, 220, "STARTTLS"); err != nil {
+		return err
+	}
+
+	tlsConn := tls.Client(c.conn, config)
+	tlsConn.SetDeadline(time.Now().Add(c.timeouts.Greeting))
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	c.conn = tlsConn
+	c.text = textproto.NewConn(tlsConn)
+
+	return c.Hello(c.hello)
+}
+
+// TLSConnectionState returns the state of the TLS layer, and false if the
+// connection is not encrypted.
+func (c *Client) TLSConnectionState() (tls.ConnectionState, bool) {
+	tlsConn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return tlsConn.ConnectionState(), true
+}
+
+// Content the remote cannot take is refused rather than converted, so it
+// bounces. Downgrade leaves out the parameters a message does not need.
+var (
+	errNoBinaryMIME = &SMTPError{Code: 554, EnhancedCode: EnhancedCode{5, 6, 3}, Message: "Remote server does not support BINARYMIME"}
+	errNo8BitMIME   = &SMTPError{Code: 554, EnhancedCode: EnhancedCode{5, 6, 3}, Message: "Remote server does not support 8BITMIME"}
+	errNoSMTPUTF8   = &SMTPError{Code: 553, EnhancedCode: EnhancedCode{5, 6, 7}, Message: "Remote server does not support SMTPUTF8"}
+)
+
+// Downgrade returns a copy of opts without the parameters the server
+// lacks but the message does not need: BODY=8BITMIME for content that is
+// all ASCII, and SMTPUTF8 when the envelope and header are. A message that
+// does need them keeps them, and Mail refuses it with a permanent error,
+// so it bounces (RFC 6152, RFC 6531 section 3.2).
+func (c *Client) Downgrade(opts *MailOptions, from string, to []string, msg string) *MailOptions {
+	if opts == nil {
+		return nil
+	}
+
+	o := *opts
+	if ok, _ := c.Extension("8BITMIME"); !ok && o.Body == Body8BitMIME && IsASCII(msg) {
+		o.Body = ""
+	}
+	if ok, _ := c.Extension("SMTPUTF8"); !ok && o.UTF8 &&
+		IsASCII(from) && IsASCII(strings.Join(to, "")) && IsASCII(HeaderSection(msg)) {
+		o.UTF8 = false
+	}
+
+	return &o
+}
+
+// HeaderSection returns the header of a message, up to and including the
+// empty line that ends it.
+func HeaderSection(msg string) string {
+	if i := strings.Index(msg, "\r\n\r\n"); i >= 0 {
+		return msg[:i+4]
+	}
+	if i := strings.Index(msg, "\n\n"); i >= 0 {
+		return msg[:i+2]
+	}
+	return msg
+}
+
+// Mail starts a transaction. opts may be nil; parameters that need an
+// extension the server lacks are an error. BODY=7BIT is only sent to a
+// server that knows the parameter, since 7-bit content needs no
+// extension.
+func (c *Client) Mail(from string, opts *MailOptions) error {
+	var params string
+	c.body = ""
+	if opts != nil && opts.Body != "" {
+		switch opts.Body {
+		case BodyBinaryMIME:
+			binary, _ := c.Extension("BINARYMIME")
+			chunking, _ := c.Extension("CHUNKING")
+			if !binary || !chunking {
+				return errNoBinaryMIME
+			}
+		case Body8BitMIME:
+			if ok, _ := c.Extension("8BITMIME"); !ok {
+				return errNo8BitMIME
+			}
+		}
+		if ok, _ := c.Extension("8BITMIME"); ok || opts.Body != Body7Bit {
+			params += " BODY=" + string(opts.Body)
+		}
+		c.body = opts.Body
+	}
+	if opts != nil && opts.UTF8 {
+		if ok, _ := c.Extension("SMTPUTF8"); !ok {
+			return errNoSMTPUTF8
+		}
+		params += " SMTPUTF8"
+	}
+
+	_, err := c.cmd(c.timeouts.Mail, 250, "MAIL FROM:<%s>%s", from, params)
+	return err
+}
+
+func (c *Client) Rcpt(to string) error {
+	_, err := c.cmd(c.timeouts.Rcpt, 250, "RCPT TO:<%s>", to)
+	return err
+}
+
+// Data sends the message with CRLF line endings and returns the server's
+// final reply. It uses BDAT if the server offers CHUNKING, and DATA with
+// dot-stuffing otherwise.
+func (c *Client) Data(r io.Reader) (string, error) {
+	if ok, _ := c.Extension("CHUNKING"); ok {
+		return c.bdat(r)
+	}
+
+	if _, err := c.cmd(c.timeouts.DataStart, 354, "DATA"); err != nil {
+		return "", err
+	}
+
+	w := c.text.DotWriter()
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			c.conn.SetDeadline(time.Now().Add(c.timeouts.DataBlock))
+			if _, err := w.Write(buf[:n]); err != nil {
+				return "", err
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return "", rerr
+		}
+	}
+
+	c.conn.SetDeadline(time.Now().Add(c.timeouts.DataBlock))
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	return c.readReply(c.timeouts.DataEnd, 250)
+}
+
+// Quit ends the session politely and closes the connection.
+func (c *Client) Quit() error {
+	_, err := c.cmd(c.timeouts.Mail, 221, "QUIT")
+	c.Close()
+	return err
+}
+
+func (c *Client) Close() error {
+	return c.text.Close()
+}
+
+func (c *Client) cmd(timeout time.Duration, expect int, format string, args ...any) (string, error) {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return "", err
+	}
+
+	return c.readReply(timeout, expect)
+}
+
+// readReply reads a possibly multi-line reply. A code other than expect
+// is returned as an *SMTPError; the reply text is returned either way.
+func (c *Client) readReply(timeout time.Duration, expect int) (string, error) {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	code, msg, err := c.text.ReadResponse(0)
+	if err != nil {
+		return "", err
+	}
+
+	if code != expect {
+		return msg, parseReplyError(code, msg)
+	}
+
+	return fmt.Sprintf("%d %s", code, msg), nil
+}
+
+// parseReplyError turns a reply into an *SMTPError, picking up an enhanced
+// status code at the start of the text.
+func parseReplyError(code int, msg string) *SMTPError {
+	smtpErr := &SMTPError{Code: code, Message: msg}
+
+	first, rest, _ := strings.Cut(msg, " ")
+	parts := strings.Split(first, ".")
+	if len(parts) != 3 {
+		return smtpErr
+	}
+	var enh EnhancedCode
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return smtpErr
+		}
+		enh[i] = n
+	}
+	smtpErr.EnhancedCode = enh
+	smtpErr.Message = rest
+
+	return smtpErr
+}
@@ -0,0 +1,755 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type sessionState int
+
+const (
+	stateInit sessionState = iota
+	stateHelo
+	stateMail
+	stateRcpt
+	stateData
+)
+
+// Conn is a single client connection and its position in the SMTP
+// state machine.
+type Conn struct {
+	// raw is the accepted TCP connection, conn is what the protocol is
+	// spoken over, which differs from raw once TLS is active.
+	raw    net.Conn
+	conn   net.Conn
+	server *Server
+	in     *connReader
+	reader *bufio.Reader
+	writer *bufio.Writer
+
+	session       Session
+	state         sessionState
+	helo          string
+	esmtp         bool
+	authenticated bool
+	rcptCount     int
+	body          BodyType
+	smtputf8      bool
+	bdat          *bdatTransfer
+	// errors counts 5xx replies, see Server.MaxErrors.
+	errors int
+
+	// idle is set while waiting for a command, draining once the server
+	// is shutting down. See drain.
+	idle     atomic.Bool
+	draining atomic.Bool
+}
+
+func newConn(conn net.Conn, s *Server) *Conn {
+	c := &Conn{raw: conn, server: s}
+	c.in = &connReader{c: c}
+	c.setConn(conn)
+	return c
+}
+
+func (c *Conn) setConn(conn net.Conn) {
+	c.conn = conn
+	c.reader = bufio.NewReader(c.in)
+	c.writer = bufio.NewWriter(conn)
+}
+
+// RemoteAddr returns the network address of the client.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// RemoteIP returns the IP address of the client, or nil if it has none.
+func (c *Conn) RemoteIP() net.IP {
+	host, _, err := net.SplitHostPort(c.conn.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// TLSConnectionState returns the state of the TLS layer, and false if the
+// connection is not encrypted.
+func (c *Conn) TLSConnectionState() (tls.ConnectionState, bool) {
+	tlsConn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return tlsConn.ConnectionState(), true
+}
+
+func (c *Conn) isTLS() bool {
+	_, ok := c.conn.(*tls.Conn)
+	return ok
+}
+
+// drain makes the session answer its next command with 421 and close. A
+// session waiting for a command is woken up right away.
+func (c *Conn) drain() {
+	c.draining.Store(true)
+	if c.idle.Load() {
+		c.raw.SetReadDeadline(time.Now())
+	}
+}
+
+// Hostname returns the name the client gave in HELO or EHLO.
+func (c *Conn) Hostname() string {
+	return c.helo
+}
+
+func (c *Conn) serve() {
+	defer func() {
+		c.writer.Flush()
+		c.conn.Close()
+	}()
+
+	// Covers an implicit TLS handshake, which happens before any read
+	// goes through c.in.
+	timeouts := c.server.Timeouts
+	if timeouts.Greeting > 0 {
+		c.conn.SetDeadline(time.Now().Add(timeouts.Greeting))
+	}
+	c.in.expect(timeouts.Greeting, timeouts.Greeting)
+
+	session, err := c.server.Backend.NewSession(c)
+	if err != nil {
+		c.writeError(err, ErrLocal)
+		return
+	}
+	c.session = session
+	defer func() {
+		c.abortBdat()
+		c.session.Logout()
+	}()
+
+	if !c.greetingAllowed() {
+		return
+	}
+	c.writeResponse(220, NoEnhancedCode, c.server.Domain+" ESMTP SimpleSMTP ready")
+
+	for first := true; ; first = false {
+		if !first {
+			c.in.expect(timeouts.Command, timeouts.Command)
+		}
+		// Replies to a pipelined group go out together, once no further
+		// command of it is waiting (RFC 2920 section 3.1).
+		if !c.server.Extensions.Pipelining || !c.commandWaiting() {
+			c.writer.Flush()
+		}
+		// idle is set before draining is checked and drain does it the
+		// other way round, so either we see the flag here or drain sees
+		// us idle and interrupts the read.
+		c.idle.Store(true)
+		if c.draining.Load() {
+			c.writeResponse(421, EnhancedCode{4, 3, 2}, "Service shutting down")
+			return
+		}
+		line, err := c.readLine()
+		c.idle.Store(false)
+		if c.draining.Load() {
+			c.writeResponse(421, EnhancedCode{4, 3, 2}, "Service shutting down")
+			return
+		}
+		if errors.Is(err, errLineTooLong) {
+			c.writeError(err, nil)
+			if !c.checkErrors() {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			c.readFailed(err)
+			return
+		}
+
+		cmd, arg := parseCommand(line)
+		switch cmd {
+		case "AUTH":
+			c.handleAuth(arg)
+		case "HELO", "EHLO":
+			c.handleHelo(cmd, arg)
+		case "STARTTLS":
+			if !c.handleStartTLS(arg) {
+				return
+			}
+		case "MAIL":
+			c.handleMail(arg)
+		case "RCPT":
+			c.handleRcpt(arg)
+		case "DATA":
+			if !c.handleData(arg) {
+				return
+			}
+		case "BDAT":
+			if !c.server.Extensions.Chunking {
+				c.writeError(errUnknownCommand, nil)
+			} else if !c.handleBdat(arg) {
+				return
+			}
+		case "RSET":
+			c.reset()
+			c.writeResponse(250, EnhancedCode{2, 0, 0}, "OK")
+		case "NOOP":
+			c.writeResponse(250, EnhancedCode{2, 0, 0}, "OK")
+		case "QUIT":
+			c.writeResponse(221, EnhancedCode{2, 0, 0}, "Bye")
+			return
+		default:
+			c.writeError(errUnknownCommand, nil)
+		}
+
+		if !c.checkErrors() {
+			return
+		}
+	}
+}
+
+// commandWaiting reports whether a complete command line has already
+// been received.
+func (c *Conn) commandWaiting() bool {
+	buf, _ := c.reader.Peek(c.reader.Buffered())
+	return bytes.IndexByte(buf, '\n') >= 0
+}
+
+// greetingAllowed holds back the greeting for Server.GreetingDelay and
+// refuses the session if the client talks first, which RFC 5321 section
+// 4.3.1 forbids and spam software often does. It reports whether to go on.
+func (c *Conn) greetingAllowed() bool {
+	delay := c.server.GreetingDelay
+	if delay <= 0 || c.isTLS() {
+		return true
+	}
+
+	c.in.expect(delay, delay)
+	_, err := c.reader.Peek(1)
+	c.in.expect(c.server.Timeouts.Greeting, c.server.Timeouts.Greeting)
+	switch {
+	case err == nil:
+		c.writeResponse(554, EnhancedCode{5, 5, 1}, c.server.Domain+" Protocol error, talking before the greeting")
+		return false
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return true
+	default:
+		return false
+	}
+}
+
+// checkErrors ends a session that has had MaxErrors 5xx replies, which is
+// more than a well-behaved client gets. It reports whether the session
+// may go on.
+func (c *Conn) checkErrors() bool {
+	if max := c.server.MaxErrors; max > 0 && c.errors >= max {
+		c.writeResponse(421, EnhancedCode{4, 7, 0}, c.server.Domain+" Too many errors, closing connection")
+		return false
+	}
+	return true
+}
+
+// readFailed handles a read error that ends the session. A client that
+// ran out of time is told so before the connection closes.
+func (c *Conn) readFailed(err error) {
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		c.writeResponse(421, EnhancedCode{4, 4, 2}, c.server.Domain+" Timeout, closing connection")
+	case err != io.EOF && err != io.ErrUnexpectedEOF && !errors.Is(err, net.ErrClosed):
+		log.Println(err)
+	}
+}
+
+// parseCommand splits line into an upper-cased verb and its argument.
+func parseCommand(line string) (string, string) {
+	cmd, arg, _ := strings.Cut(line, " ")
+	return strings.ToUpper(cmd), strings.TrimSpace(arg)
+}
+
+func (c *Conn) handleAuth(arg string) {
+	if c.authenticated {
+		c.writeResponse(503, EnhancedCode{5, 5, 1}, "Already authenticated")
+		return
+	}
+
+	if len(c.server.authMechanisms()) == 0 {
+		c.writeResponse(502, EnhancedCode{5, 5, 1}, "AUTH not available")
+		return
+	}
+	if c.server.AuthRequiresTLS && !c.isTLS() {
+		c.writeResponse(538, EnhancedCode{5, 7, 11}, "Encryption required for requested authentication mechanism")
+		return
+	}
+
+	name, ir, hasIR := strings.Cut(arg, " ")
+	mech, ok := c.server.authMechanism(strings.ToUpper(name))
+	if !ok {
+		c.writeResponse(504, EnhancedCode{5, 5, 4}, "Unrecognized authentication type")
+		return
+	}
+
+	// A nil response tells the mechanism no initial response was sent,
+	// "=" is an empty one.
+	var response []byte
+	if hasIR {
+		var ok bool
+		if response, ok = c.decodeAuthResponse(ir); !ok {
+			return
+		}
+	}
+
+	sasl := mech(c)
+	for {
+		challenge, done, err := sasl.Next(response)
+		if err != nil {
+			c.writeError(err, ErrAuthFailed)
+			return
+		}
+		if done {
+			break
+		}
+
+		c.writeResponse(334, NoEnhancedCode, base64.StdEncoding.EncodeToString(challenge))
+		c.writer.Flush()
+		c.in.expect(c.server.Timeouts.Command, c.server.Timeouts.Command)
+		line, err := c.readLine()
+		if errors.Is(err, errLineTooLong) {
+			c.writeResponse(500, EnhancedCode{5, 5, 6}, "Authentication exchange line is too long")
+			return
+		}
+		if err != nil {
+			return
+		}
+		if response, ok = c.decodeAuthResponse(line); !ok {
+			return
+		}
+	}
+
+	c.authenticated = true
+	c.writeResponse(235, EnhancedCode{2, 7, 0}, "Authentication successful")
+}
+
+// decodeAuthResponse decodes one base64 encoded client response of a SASL
+// exchange, answering the client itself if the exchange has to stop.
+func (c *Conn) decodeAuthResponse(line string) ([]byte, bool) {
+	switch line {
+	case "*":
+		c.writeResponse(501, EnhancedCode{5, 0, 0}, "Authentication cancelled")
+		return nil, false
+	case "=":
+		return []byte{}, true
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		c.writeResponse(501, EnhancedCode{5, 5, 2}, "Invalid base64 data")
+		return nil, false
+	}
+
+	return decoded, true
+}
+
+// handleHelo answers HELO and EHLO. Both are accepted before AUTH, since
+// the client needs the EHLO reply to learn which mechanisms are offered,
+// and both abort any transaction in progress.
+func (c *Conn) handleHelo(cmd, arg string) {
+	if arg == "" {
+		c.writeResponse(501, EnhancedCode{5, 5, 4}, "Syntax: "+cmd+" hostname")
+		return
+	}
+
+	c.reset()
+	c.helo = arg
+	c.esmtp = cmd == "EHLO"
+	c.state = stateHelo
+
+	if !c.esmtp {
+		c.writeResponse(250, NoEnhancedCode, c.server.Domain+" Hello "+arg)
+		return
+	}
+
+	lines := append([]string{c.server.Domain + " Hello " + arg}, c.extensions()...)
+	c.writeResponse(250, NoEnhancedCode, lines...)
+}
+
+// extensions lists the EHLO keywords for this connection. Every entry must
+// be backed by working code and gated on the server option enabling it.
+func (c *Conn) extensions() []string {
+	exts := c.server.Extensions.keywords()
+
+	if _, max := c.server.messageLimits(); max > 0 {
+		exts = append(exts, "SIZE "+strconv.FormatInt(max, 10))
+	}
+	if c.server.TLSConfig != nil && !c.isTLS() {
+		exts = append(exts, "STARTTLS")
+	}
+	if !c.authenticated && (c.isTLS() || !c.server.AuthRequiresTLS) {
+		if mechs := c.server.authMechanisms(); len(mechs) > 0 {
+			exts = append(exts, "AUTH "+strings.Join(mechs, " "))
+		}
+	}
+
+	return exts
+}
+
+// handleStartTLS upgrades the connection. As RFC 3207 requires, everything
+// learned before the handshake is thrown away, including the session, so
+// the client has to EHLO and authenticate again. It reports whether the
+// connection is still usable.
+func (c *Conn) handleStartTLS(arg string) bool {
+	if arg != "" {
+		c.writeResponse(501, EnhancedCode{5, 5, 4}, "STARTTLS takes no arguments")
+		return true
+	}
+	if c.isTLS() {
+		c.writeResponse(503, EnhancedCode{5, 5, 1}, "TLS already active")
+		return true
+	}
+	if c.server.TLSConfig == nil {
+		c.writeResponse(502, EnhancedCode{5, 5, 1}, "TLS not available")
+		return true
+	}
+
+	c.writeResponse(220, EnhancedCode{2, 0, 0}, "Ready to start TLS")
+	c.writer.Flush()
+
+	// Anything the client pipelined after STARTTLS arrived in plaintext
+	// and is dropped with the old reader rather than run inside TLS.
+
+	tlsConn := tls.Server(c.conn, c.server.TLSConfig)
+	if t := c.server.Timeouts.Command; t > 0 {
+		c.conn.SetDeadline(time.Now().Add(t))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		log.Println("TLS handshake failed:", err)
+		return false
+	}
+	c.setConn(tlsConn)
+
+	c.abortBdat()
+	c.session.Logout()
+	session, err := c.server.Backend.NewSession(c)
+	if err != nil {
+		c.writeError(err, ErrLocal)
+		return false
+	}
+	c.session = session
+	c.state = stateInit
+	c.rcptCount = 0
+	c.body = ""
+	c.smtputf8 = false
+	c.helo = ""
+	c.esmtp = false
+	c.authenticated = false
+
+	return true
+}
+
+func (c *Conn) handleMail(arg string) {
+	if !c.validateState(stateHelo) {
+		return
+	}
+
+	arg, ok := cutPrefixFold(arg, "FROM:")
+	if !ok {
+		c.writeResponse(501, EnhancedCode{5, 5, 4}, "Syntax: MAIL FROM:<address>")
+		return
+	}
+	path, params, err := parsePathArgs(arg)
+	if err != nil {
+		c.writeError(err, nil)
+		return
+	}
+	if !c.checkParams(params) {
+		return
+	}
+	// The path can only be checked once SMTPUTF8 is known; checkParams
+	// has made sure it is on if given.
+	_, smtputf8 := params["SMTPUTF8"]
+	from, err := parseReversePath(path, smtputf8)
+	if err != nil {
+		c.writeError(err, nil)
+		return
+	}
+
+	opts := &MailOptions{}
+	for key, value := range params {
+		switch key {
+		case "SIZE":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				c.writeError(errSyntaxParams, nil)
+				return
+			}
+			if _, max := c.server.messageLimits(); max > 0 && size > max {
+				c.writeError(ErrDataTooLarge, nil)
+				return
+			}
+			opts.Size = size
+		case "BODY":
+			body := BodyType(strings.ToUpper(value))
+			if body != Body7Bit && body != Body8BitMIME && body != BodyBinaryMIME {
+				c.writeError(errSyntaxParams, nil)
+				return
+			}
+			if !c.server.Extensions.body(body) {
+				c.writeResponse(555, EnhancedCode{5, 5, 4}, "Unsupported parameter BODY="+string(body))
+				return
+			}
+			opts.Body = body
+		case "RET":
+			ret := DSNReturn(strings.ToUpper(value))
+			if ret != DSNReturnFull && ret != DSNReturnHeaders {
+				c.writeError(errSyntaxParams, nil)
+				return
+			}
+			opts.Return = ret
+		case "ENVID":
+			envid, err := decodeXtext(value)
+			if err != nil || value == "" || len(value) > 100 {
+				c.writeError(errSyntaxParams, nil)
+				return
+			}
+			opts.EnvelopeID = envid
+		case "SMTPUTF8":
+			if value != "" {
+				c.writeError(errSyntaxParams, nil)
+				return
+			}
+			opts.UTF8 = true
+		default:
+			c.writeResponse(555, EnhancedCode{5, 5, 4}, "Unsupported parameter "+key)
+			return
+		}
+	}
+
+	if err := c.session.Mail(from, opts); err != nil {
+		c.writeError(err, ErrLocal)
+		return
+	}
+
+	c.state = stateMail
+	c.body = opts.Body
+	c.smtputf8 = opts.UTF8
+	c.writeResponse(250, EnhancedCode{2, 1, 0}, "Sender OK")
+}
+
+func (c *Conn) handleRcpt(arg string) {
+	if !c.validateState(stateMail, stateRcpt) {
+		return
+	}
+	if max, _ := c.server.messageLimits(); max > 0 && c.rcptCount >= max {
+		c.writeResponse(452, EnhancedCode{4, 5, 3}, "Too many recipients")
+		return
+	}
+
+	arg, ok := cutPrefixFold(arg, "TO:")
+	if !ok {
+		c.writeResponse(501, EnhancedCode{5, 5, 4}, "Syntax: RCPT TO:<address>")
+		return
+	}
+	path, params, err := parsePathArgs(arg)
+	if err != nil {
+		c.writeError(err, nil)
+		return
+	}
+	to, err := parseForwardPath(path, c.smtputf8)
+	if err != nil {
+		c.writeError(err, nil)
+		return
+	}
+	if !c.checkParams(params) {
+		return
+	}
+	opts := &RcptOptions{}
+	for key, value := range params {
+		switch key {
+		case "NOTIFY":
+			notify, err := parseNotify(value)
+			if err != nil {
+				c.writeError(err, nil)
+				return
+			}
+			opts.Notify = notify
+		case "ORCPT":
+			addrType, addr, err := parseORCPT(value)
+			if err != nil || len(value) > 500 {
+				c.writeError(errSyntaxParams, nil)
+				return
+			}
+			opts.OriginalRecipientType, opts.OriginalRecipient = addrType, addr
+		default:
+			c.writeResponse(555, EnhancedCode{5, 5, 4}, "Unsupported parameter "+key)
+			return
+		}
+	}
+
+	if err := c.session.Rcpt(to, opts); err != nil {
+		c.writeError(err, ErrLocal)
+		return
+	}
+
+	c.rcptCount++
+	c.state = stateRcpt
+	c.writeResponse(250, EnhancedCode{2, 1, 5}, "Recipient OK")
+}
+
+// checkParams refuses ESMTP parameters from a client that did not EHLO,
+// and those of extensions that are off.
+func (c *Conn) checkParams(params map[string]string) bool {
+	if len(params) > 0 && !c.esmtp {
+		c.writeResponse(555, EnhancedCode{5, 5, 4}, "Parameters require EHLO")
+		return false
+	}
+	for key := range params {
+		if !c.server.Extensions.param(key) {
+			c.writeResponse(555, EnhancedCode{5, 5, 4}, "Unsupported parameter "+key)
+			return false
+		}
+	}
+	return true
+}
+
+// handleData reads the message and passes it to the backend. It reports
+// whether the connection is still usable.
+func (c *Conn) handleData(arg string) bool {
+	if arg != "" {
+		c.writeResponse(501, EnhancedCode{5, 5, 4}, "DATA takes no arguments")
+		return true
+	}
+	if !c.validateState(stateRcpt) {
+		return true
+	}
+	if c.body == BodyBinaryMIME {
+		c.writeError(errBinaryData, nil)
+		return true
+	}
+	c.state = stateData
+
+	c.writeResponse(354, NoEnhancedCode, "End data with <CR><LF>.<CR><LF>")
+	c.writer.Flush()
+
+	c.in.expect(c.server.Timeouts.DataBlock, c.server.Timeouts.DataTermination)
+	_, maxBytes := c.server.messageLimits()
+	r := newDataReader(c.reader, maxBytes)
+	err := c.session.Data(r)
+	if ioErr := r.drain(); ioErr != nil {
+		c.readFailed(ioErr)
+		return false
+	}
+
+	switch {
+	case r.tooLarge:
+		c.writeError(ErrDataTooLarge, nil)
+	case err != nil:
+		c.writeError(err, ErrLocal)
+	default:
+		c.writeResponse(250, EnhancedCode{2, 0, 0}, "Message accepted")
+	}
+
+	c.reset()
+	return true
+}
+
+func (c *Conn) validateState(valid ...sessionState) bool {
+	if c.server.AuthRequired && !c.authenticated {
+		c.writeError(ErrAuthRequired, nil)
+		return false
+	}
+
+	if !slices.Contains(valid, c.state) {
+		c.writeError(ErrBadSequence, nil)
+		return false
+	}
+
+	return true
+}
+
+func (c *Conn) reset() {
+	c.abortBdat()
+	c.session.Reset()
+	c.rcptCount = 0
+	c.body = ""
+	c.smtputf8 = false
+	if c.state != stateInit {
+		c.state = stateHelo
+	}
+}
+
+// readLine reads a line of at most MaxLineLength bytes. A longer line is
+// read to its end and reported as errLineTooLong, so the session can
+// answer it and go on.
+func (c *Conn) readLine() (string, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := c.reader.ReadSlice('\n')
+		if !tooLong {
+			line = append(line, chunk...)
+			if max := c.server.MaxLineLength; max > 0 && len(line) > max {
+				tooLong, line = true, nil
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+
+	if tooLong {
+		return "", errLineTooLong
+	}
+	return strings.TrimSpace(string(line)), nil
+}
+
+// writeResponse sends a reply, as a multi-line reply if more than one line
+// of text is given. The enhanced code, if any, prefixes every line while
+// ENHANCEDSTATUSCODES is on.
+func (c *Conn) writeResponse(code int, enh EnhancedCode, text ...string) {
+	if code >= 500 {
+		c.errors++
+	}
+	if t := c.server.Timeouts.Command; t > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(t))
+	}
+
+	for i, line := range text {
+		sep := "-"
+		if i == len(text)-1 {
+			sep = " "
+		}
+		if enh != NoEnhancedCode && c.server.Extensions.EnhancedStatusCodes {
+			line = enh.String() + " " + line
+		}
+		fmt.Fprintf(c.writer, "%d%s%s\r\n", code, sep, line)
+	}
+}
+
+func (c *Conn) writeError(err error, def *SMTPError) {
+	smtpErr := toSMTPError(err, def)
+	c.writeResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+}
+
+// cutPrefixFold is strings.CutPrefix with a case-insensitive prefix.
+func cutPrefixFold(s, prefix string) (string, bool) {
+	if len(s) < len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
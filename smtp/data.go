@@ -0,0 +1,104 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// dataReader streams the content of a DATA command. Line endings and all
+// other bytes are passed through untouched, the leading dot of a stuffed
+// line is removed and CRLF "." CRLF ends the stream with io.EOF.
+type dataReader struct {
+	r   *bufio.Reader
+	max int64
+
+	n         int64
+	buf       []byte
+	lineStart bool
+	// cr is whether the last piece read ended in CR, in case a CRLF was
+	// split between two pieces.
+	cr       bool
+	done     bool
+	tooLarge bool
+	err      error
+}
+
+func newDataReader(r *bufio.Reader, max int64) *dataReader {
+	return &dataReader{r: r, max: max, lineStart: true}
+}
+
+func (d *dataReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		d.buf, d.err = d.next()
+	}
+
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// next returns the next piece of message content, which aliases the
+// bufio.Reader buffer and is only valid until the following call.
+func (d *dataReader) next() ([]byte, error) {
+	if d.done {
+		return nil, io.EOF
+	}
+
+	line, err := d.r.ReadSlice('\n')
+	if err != nil && err != bufio.ErrBufferFull {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	// Only CRLF ends a line (RFC 5321 section 4.1.1.4). A "." after a bare
+	// LF is content, so it cannot end the message early and have what
+	// follows taken for further commands.
+	start := d.lineStart
+	d.lineStart = err == nil && (bytes.HasSuffix(line, []byte("\r\n")) || d.cr && string(line) == "\n")
+	d.cr = line[len(line)-1] == '\r'
+
+	if start {
+		if string(line) == ".\r\n" {
+			d.done = true
+			if d.tooLarge {
+				return nil, ErrDataTooLarge
+			}
+			return nil, io.EOF
+		}
+		if line[0] == '.' {
+			line = line[1:]
+		}
+	}
+
+	d.n += int64(len(line))
+	if d.max > 0 && d.n > d.max {
+		d.tooLarge = true
+		return nil, ErrDataTooLarge
+	}
+
+	return line, nil
+}
+
+// drain consumes the rest of the message, up to and including the final
+// "." line, so the connection can go on after the backend has stopped
+// reading early. Only I/O errors are returned.
+func (d *dataReader) drain() error {
+	d.buf = nil
+	d.max = 0
+	for {
+		_, err := d.next()
+		if err == nil || err == ErrDataTooLarge {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+}
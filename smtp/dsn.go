@@ -0,0 +1,138 @@
+package smtp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DSNReturn is the RET parameter of MAIL FROM (RFC 3461 section 4.3).
+type DSNReturn string
+
+const (
+	DSNReturnFull    DSNReturn = "FULL"
+	DSNReturnHeaders DSNReturn = "HDRS"
+)
+
+// DSNNotify is one value of the NOTIFY parameter of RCPT TO (RFC 3461
+// section 4.1).
+type DSNNotify string
+
+const (
+	DSNNotifyNever   DSNNotify = "NEVER"
+	DSNNotifySuccess DSNNotify = "SUCCESS"
+	DSNNotifyFailure DSNNotify = "FAILURE"
+	DSNNotifyDelay   DSNNotify = "DELAY"
+)
+
+// MailOptions holds the ESMTP parameters given with MAIL FROM.
+type MailOptions struct {
+	// Size is the message size the client announced, or 0.
+	Size int64
+	// Return says how much of the message a failure DSN should include.
+	// It is empty if the client did not say.
+	Return DSNReturn
+	// EnvelopeID is the decoded ENVID parameter.
+	EnvelopeID string
+	// Body is the BODY parameter, empty if not given.
+	Body BodyType
+	// UTF8 is set by the SMTPUTF8 parameter: the addresses and header of
+	// the message may hold UTF-8 (RFC 6531).
+	UTF8 bool
+}
+
+// RcptOptions holds the ESMTP parameters given with RCPT TO.
+type RcptOptions struct {
+	// Notify lists the conditions the client wants a DSN for, and is nil
+	// if the client did not say.
+	Notify []DSNNotify
+	// OriginalRecipientType and OriginalRecipient are the decoded ORCPT
+	// parameter, usually "rfc822" and an address.
+	OriginalRecipientType string
+	OriginalRecipient     string
+}
+
+// parseNotify checks a NOTIFY value: either NEVER alone or any of SUCCESS,
+// FAILURE and DELAY.
+func parseNotify(value string) ([]DSNNotify, error) {
+	var notify []DSNNotify
+	for _, v := range strings.Split(strings.ToUpper(value), ",") {
+		n := DSNNotify(v)
+		switch n {
+		case DSNNotifyNever, DSNNotifySuccess, DSNNotifyFailure, DSNNotifyDelay:
+		default:
+			return nil, errSyntaxParams
+		}
+		for _, seen := range notify {
+			if seen == n {
+				return nil, errSyntaxParams
+			}
+		}
+		notify = append(notify, n)
+	}
+	for _, n := range notify {
+		if n == DSNNotifyNever && len(notify) > 1 {
+			return nil, errSyntaxParams
+		}
+	}
+
+	return notify, nil
+}
+
+// parseORCPT splits an ORCPT value into its address type and decoded
+// address.
+func parseORCPT(value string) (string, string, error) {
+	addrType, addr, ok := strings.Cut(value, ";")
+	if !ok || addrType == "" || addr == "" {
+		return "", "", errSyntaxParams
+	}
+	addr, err := decodeXtext(addr)
+	if err != nil {
+		return "", "", err
+	}
+
+	return addrType, addr, nil
+}
+
+// decodeXtext undoes the xtext encoding of RFC 3461 section 4, where any
+// character can be written as "+" and two upper-case hex digits.
+func decodeXtext(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '+':
+			if i+2 >= len(s) {
+				return "", errSyntaxParams
+			}
+			v, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", errSyntaxParams
+			}
+			b.WriteByte(byte(v))
+			i += 2
+		case c < '!' || c > '~' || c == '=':
+			return "", errSyntaxParams
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String(), nil
+}
+
+// EncodeXtext encodes s as xtext, for ENVID and ORCPT values passed on to
+// another server or written into a DSN.
+func EncodeXtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,68 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// EnhancedCode is an RFC 3463 enhanced status code such as 5.7.8.
+type EnhancedCode [3]int
+
+// NoEnhancedCode is used for replies that must not carry an enhanced code,
+// such as the greeting, EHLO and AUTH challenges.
+var NoEnhancedCode = EnhancedCode{}
+
+func (e EnhancedCode) String() string {
+	return fmt.Sprintf("%d.%d.%d", e[0], e[1], e[2])
+}
+
+var errUnknownCommand = &SMTPError{Code: 500, EnhancedCode: EnhancedCode{5, 5, 2}, Message: "Syntax error, command unrecognized"}
+
+// SMTPError is an error that carries the reply sent to the client.
+type SMTPError struct {
+	Code         int
+	EnhancedCode EnhancedCode
+	Message      string
+}
+
+func (e *SMTPError) Error() string {
+	if e.EnhancedCode == NoEnhancedCode {
+		return fmt.Sprintf("%d %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("%d %s %s", e.Code, e.EnhancedCode, e.Message)
+}
+
+// Temporary reports whether the reply is a transient 4xx failure.
+func (e *SMTPError) Temporary() bool {
+	return e.Code/100 == 4
+}
+
+// IsPermanent reports whether err is a 5xx reply. Network failures and
+// anything else that is not a reply count as temporary.
+func IsPermanent(err error) bool {
+	var smtpErr *SMTPError
+	return errors.As(err, &smtpErr) && smtpErr.Code/100 == 5
+}
+
+var (
+	ErrServerClosed = errors.New("smtp: server closed")
+
+	ErrAuthFailed   = &SMTPError{Code: 535, EnhancedCode: EnhancedCode{5, 7, 8}, Message: "Authentication failed"}
+	ErrAuthRequired = &SMTPError{Code: 530, EnhancedCode: EnhancedCode{5, 7, 0}, Message: "Authentication required"}
+	ErrBadSequence  = &SMTPError{Code: 503, EnhancedCode: EnhancedCode{5, 5, 1}, Message: "Bad sequence of commands"}
+	ErrLocal        = &SMTPError{Code: 451, EnhancedCode: EnhancedCode{4, 3, 0}, Message: "Local error in processing"}
+	ErrDataTooLarge = &SMTPError{Code: 552, EnhancedCode: EnhancedCode{5, 3, 4}, Message: "Maximum message size exceeded"}
+)
+
+// toSMTPError returns err as an *SMTPError, falling back to def for errors
+// that do not carry a reply of their own.
+func toSMTPError(err error, def *SMTPError) *SMTPError {
+	var smtpErr *SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr
+	}
+	return def
+}
+
+// errLineTooLong answers a command line over Server.MaxLineLength.
+var errLineTooLong = &SMTPError{Code: 500, EnhancedCode: EnhancedCode{5, 5, 2}, Message: "Line too long"}
@@ -0,0 +1,95 @@
+package smtp
+
+// Extensions switches the optional ESMTP extensions on and off. One that
+// is off is not advertised, and its command or parameters are refused as
+// if the server had never heard of them. SIZE, STARTTLS and AUTH follow
+// from MaxMessageBytes, TLSConfig and the registered mechanisms instead.
+type Extensions struct {
+	// Pipelining lets replies to a group of commands go out together
+	// (RFC 2920). When off, every reply is flushed on its own.
+	Pipelining bool
+	// EnhancedStatusCodes prefixes replies with RFC 3463 codes.
+	EnhancedStatusCodes bool
+	// DSN accepts the RET and ENVID parameters of MAIL and NOTIFY and
+	// ORCPT of RCPT (RFC 3461).
+	DSN bool
+	// EightBitMIME accepts BODY=7BIT and BODY=8BITMIME (RFC 6152).
+	EightBitMIME bool
+	// Chunking accepts BDAT (RFC 3030).
+	Chunking bool
+	// BinaryMIME accepts BODY=BINARYMIME. It needs Chunking, and is off
+	// without it.
+	BinaryMIME bool
+	// SMTPUTF8 accepts the SMTPUTF8 parameter and UTF-8 addresses with it
+	// (RFC 6531).
+	SMTPUTF8 bool
+}
+
+// AllExtensions has every extension on, as NewServer sets it.
+var AllExtensions = Extensions{
+	Pipelining:          true,
+	EnhancedStatusCodes: true,
+	DSN:                 true,
+	EightBitMIME:        true,
+	Chunking:            true,
+	BinaryMIME:          true,
+	SMTPUTF8:            true,
+}
+
+// keywords lists the EHLO keywords of the extensions that are on.
+func (e Extensions) keywords() []string {
+	var kw []string
+	if e.Pipelining {
+		kw = append(kw, "PIPELINING")
+	}
+	if e.EnhancedStatusCodes {
+		kw = append(kw, "ENHANCEDSTATUSCODES")
+	}
+	if e.DSN {
+		kw = append(kw, "DSN")
+	}
+	if e.EightBitMIME {
+		kw = append(kw, "8BITMIME")
+	}
+	if e.Chunking {
+		kw = append(kw, "CHUNKING")
+	}
+	if e.binaryMIME() {
+		kw = append(kw, "BINARYMIME")
+	}
+	if e.SMTPUTF8 {
+		kw = append(kw, "SMTPUTF8")
+	}
+	return kw
+}
+
+func (e Extensions) binaryMIME() bool {
+	return e.BinaryMIME && e.Chunking
+}
+
+// param reports whether the extension defining an ESMTP parameter of MAIL
+// or RCPT is on. SIZE is always accepted.
+func (e Extensions) param(key string) bool {
+	switch key {
+	case "RET", "ENVID", "NOTIFY", "ORCPT":
+		return e.DSN
+	case "BODY":
+		return e.EightBitMIME || e.binaryMIME()
+	case "SMTPUTF8":
+		return e.SMTPUTF8
+	}
+	return true
+}
+
+// body reports whether a BODY value is accepted.
+func (e Extensions) body(body BodyType) bool {
+	switch body {
+	case Body7Bit:
+		return e.EightBitMIME || e.binaryMIME()
+	case Body8BitMIME:
+		return e.EightBitMIME
+	case BodyBinaryMIME:
+		return e.binaryMIME()
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package smtp
+
+import (
+	"strings"
+)
+
+var errSyntaxParams = &SMTPError{Code: 501, EnhancedCode: EnhancedCode{5, 5, 4}, Message: "Syntax error in parameters"}
+
+// parsePathArgs splits the argument of MAIL FROM: or RCPT TO: into the
+// path, without its angle brackets, and the ESMTP parameters that follow
+// it. Parameter keywords are upper-cased; a keyword without "=" maps to
+// an empty value. The path itself is checked by parseReversePath or
+// parseForwardPath.
+func parsePathArgs(arg string) (string, map[string]string, error) {
+	arg = strings.TrimLeft(arg, " ")
+	if !strings.HasPrefix(arg, "<") {
+		return "", nil, errPathSyntax
+	}
+
+	// A quoted local part may contain '>', so the closing bracket is the
+	// first one outside quotes.
+	end := -1
+	for i := 1; i < len(arg) && end < 0; i++ {
+		switch arg[i] {
+		case '"':
+			n, ok := quotedEnd(arg[i:])
+			if !ok {
+				return "", nil, errPathSyntax
+			}
+			i += n - 1
+		case '>':
+			end = i
+		}
+	}
+	if end < 0 {
+		return "", nil, errPathSyntax
+	}
+	path, rest := arg[1:end], arg[end+1:]
+	if rest != "" && rest[0] != ' ' {
+		return "", nil, errPathSyntax
+	}
+
+	params := make(map[string]string)
+	for _, field := range strings.Fields(rest) {
+		key, value, _ := strings.Cut(field, "=")
+		if key == "" {
+			return "", nil, errSyntaxParams
+		}
+		params[strings.ToUpper(key)] = value
+	}
+
+	return path, params, nil
+}
@@ -0,0 +1,142 @@
+package smtp
+
+import (
+	"bytes"
+	"sort"
+)
+
+var errMalformedAuth = &SMTPError{Code: 501, EnhancedCode: EnhancedCode{5, 5, 2}, Message: "Malformed authentication data"}
+
+// SASLServer is the server side of one SASL exchange.
+type SASLServer interface {
+	// Next consumes the client's response and returns the next challenge.
+	// The first call gets a nil response unless the client sent an initial
+	// response with AUTH. done reports a successful authentication.
+	Next(response []byte) (challenge []byte, done bool, err error)
+}
+
+// SASLMechanism starts an exchange for the given connection.
+type SASLMechanism func(c *Conn) SASLServer
+
+// EnableAuth registers mech under name, replacing any mechanism already
+// registered with that name. NewServer enables PLAIN and LOGIN.
+func (s *Server) EnableAuth(name string, mech SASLMechanism) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.auths[name] = mech
+}
+
+// DisableAuth removes the named mechanisms, or every mechanism if no name
+// is given. A server without mechanisms neither advertises nor accepts
+// AUTH.
+func (s *Server) DisableAuth(names ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(names) == 0 {
+		clear(s.auths)
+	}
+	for _, name := range names {
+		delete(s.auths, name)
+	}
+}
+
+func (s *Server) authMechanism(name string) (SASLMechanism, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mech, ok := s.auths[name]
+	return mech, ok
+}
+
+func (s *Server) authMechanisms() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.auths))
+	for name := range s.auths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CheckAuthAllowed runs the session's AuthLimiter, if any, for username.
+// Mechanisms call it as soon as they know who the client claims to be.
+func (c *Conn) CheckAuthAllowed(username string) error {
+	if limiter, ok := c.session.(AuthLimiter); ok {
+		return limiter.AuthAllowed(username)
+	}
+	return nil
+}
+
+// Session returns the backend session of the connection.
+func (c *Conn) Session() Session {
+	return c.session
+}
+
+// plainServer implements RFC 4616 PLAIN.
+type plainServer struct {
+	c *Conn
+}
+
+func PlainMechanism(c *Conn) SASLServer {
+	return &plainServer{c: c}
+}
+
+func (p *plainServer) Next(response []byte) ([]byte, bool, error) {
+	if response == nil {
+		return []byte{}, false, nil
+	}
+
+	parts := bytes.Split(response, []byte{0})
+	if len(parts) != 3 {
+		return nil, false, errMalformedAuth
+	}
+	authzid, username, password := string(parts[0]), string(parts[1]), string(parts[2])
+	if authzid != "" && authzid != username {
+		return nil, false, ErrAuthFailed
+	}
+
+	if err := p.c.CheckAuthAllowed(username); err != nil {
+		return nil, false, err
+	}
+	if err := p.c.session.Auth(username, password); err != nil {
+		return nil, false, err
+	}
+
+	return nil, true, nil
+}
+
+// loginServer implements the non-standard but widespread LOGIN mechanism.
+// The client may send the username as initial response.
+type loginServer struct {
+	c        *Conn
+	username string
+	step     int
+}
+
+func LoginMechanism(c *Conn) SASLServer {
+	return &loginServer{c: c}
+}
+
+func (l *loginServer) Next(response []byte) ([]byte, bool, error) {
+	switch l.step {
+	case 0:
+		l.step++
+		if response == nil {
+			return []byte("Username:"), false, nil
+		}
+		fallthrough
+	case 1:
+		l.step = 2
+		l.username = string(response)
+		if err := l.c.CheckAuthAllowed(l.username); err != nil {
+			return nil, false, err
+		}
+		return []byte("Password:"), false, nil
+	default:
+		if err := l.c.session.Auth(l.username, string(response)); err != nil {
+			return nil, false, err
+		}
+		return nil, true, nil
+	}
+}
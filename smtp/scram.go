@@ -0,0 +1,243 @@
+package smtp
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// SCRAMIterations is the PBKDF2 iteration count used by NewSCRAMCredentials.
+const SCRAMIterations = 4096
+
+// SCRAMCredentials is the verifier stored for a user so SCRAM-SHA-256 can
+// be used without keeping the password itself.
+type SCRAMCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewSCRAMCredentials derives the SCRAM-SHA-256 verifier for password with
+// a random salt.
+func NewSCRAMCredentials(password string) (*SCRAMCredentials, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	salted, err := pbkdf2.Key(sha256.New, password, salt, SCRAMIterations, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	clientKey := hmacSHA256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+
+	return &SCRAMCredentials{
+		Salt:       salt,
+		Iterations: SCRAMIterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  hmacSHA256(salted, "Server Key"),
+	}, nil
+}
+
+// SCRAMSession may be implemented by a Session whose users have SCRAM
+// verifiers, to make the SCRAM-SHA-256 mechanism usable.
+type SCRAMSession interface {
+	// SCRAMCredentials returns the verifier stored for username, or
+	// ErrAuthFailed if there is none. The exchange then goes on with a
+	// made-up verifier and fails only at the end, so clients cannot probe
+	// which users exist (RFC 5802 section 9).
+	SCRAMCredentials(username string) (*SCRAMCredentials, error)
+	// SCRAMResult reports whether username proved the password. It may
+	// still refuse a successful exchange by returning an error.
+	SCRAMResult(username string, ok bool) error
+}
+
+// scramServer implements RFC 5802/7677 SCRAM-SHA-256 without channel
+// binding.
+type scramServer struct {
+	c     *Conn
+	step  int
+	user  string
+	creds *SCRAMCredentials
+	nonce string
+
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	serverSignature []byte
+}
+
+func SCRAMSHA256Mechanism(c *Conn) SASLServer {
+	return &scramServer{c: c}
+}
+
+func (s *scramServer) Next(response []byte) ([]byte, bool, error) {
+	if response == nil && s.step == 0 {
+		return []byte{}, false, nil
+	}
+
+	switch s.step {
+	case 0:
+		s.step++
+		return s.clientFirst(string(response))
+	case 1:
+		s.step++
+		return s.clientFinal(string(response))
+	default:
+		// The client acknowledges our server-final-message.
+		return nil, true, nil
+	}
+}
+
+func (s *scramServer) clientFirst(msg string) ([]byte, bool, error) {
+	session, ok := s.c.session.(SCRAMSession)
+	if !ok {
+		return nil, false, ErrAuthFailed
+	}
+
+	// gs2-header: we never offer SCRAM-SHA-256-PLUS, so "p=" is refused.
+	cbind, rest, ok := strings.Cut(msg, ",")
+	if !ok || (cbind != "n" && cbind != "y") {
+		return nil, false, errMalformedAuth
+	}
+	authzid, bare, ok := strings.Cut(rest, ",")
+	if !ok {
+		return nil, false, errMalformedAuth
+	}
+
+	attrs := scramAttrs(bare)
+	user, err := scramUnescape(attrs["n"])
+	if err != nil || attrs["r"] == "" {
+		return nil, false, errMalformedAuth
+	}
+	if authzid != "" && authzid != "a="+attrs["n"] {
+		return nil, false, ErrAuthFailed
+	}
+
+	if err := s.c.CheckAuthAllowed(user); err != nil {
+		return nil, false, err
+	}
+	creds, err := session.SCRAMCredentials(user)
+	if errors.Is(err, ErrAuthFailed) {
+		creds = fakeSCRAMCredentials(s.c.server.SCRAMSecret, user)
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	serverNonce := make([]byte, 18)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return nil, false, ErrLocal
+	}
+
+	s.user = user
+	s.creds = creds
+	s.nonce = attrs["r"] + base64.RawStdEncoding.EncodeToString(serverNonce)
+	s.gs2Header = cbind + "," + authzid + ","
+	s.clientFirstBare = bare
+	s.serverFirst = "r=" + s.nonce +
+		",s=" + base64.StdEncoding.EncodeToString(creds.Salt) +
+		",i=" + strconv.Itoa(creds.Iterations)
+
+	return []byte(s.serverFirst), false, nil
+}
+
+func (s *scramServer) clientFinal(msg string) ([]byte, bool, error) {
+	session := s.c.session.(SCRAMSession)
+
+	withoutProof, proofAttr, ok := strings.Cut(msg, ",p=")
+	if !ok {
+		return nil, false, errMalformedAuth
+	}
+	attrs := scramAttrs(withoutProof)
+	proof, err := base64.StdEncoding.DecodeString(proofAttr)
+	// Without channel binding, c= must repeat the gs2-header of the
+	// client-first-message, so a downgrade from "y" to "n" is noticed.
+	cbind := base64.StdEncoding.EncodeToString([]byte(s.gs2Header))
+	if err != nil || attrs["c"] != cbind || attrs["r"] != s.nonce || len(proof) != sha256.Size {
+		session.SCRAMResult(s.user, false)
+		return nil, false, ErrAuthFailed
+	}
+
+	authMessage := s.clientFirstBare + "," + s.serverFirst + "," + withoutProof
+	clientSignature := hmacSHA256(s.creds.StoredKey, authMessage)
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+
+	if subtle.ConstantTimeCompare(storedKey[:], s.creds.StoredKey) != 1 {
+		session.SCRAMResult(s.user, false)
+		return nil, false, ErrAuthFailed
+	}
+	if err := session.SCRAMResult(s.user, true); err != nil {
+		return nil, false, err
+	}
+
+	s.serverSignature = hmacSHA256(s.creds.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(s.serverSignature)), false, nil
+}
+
+// fakeSCRAMCredentials stands in for the verifier of an unknown user. The
+// salt is derived from the name, so it is the same on every attempt as a
+// real one would be; the keys are random, so no proof matches them.
+func fakeSCRAMCredentials(secret []byte, username string) *SCRAMCredentials {
+	key := make([]byte, sha256.Size)
+	rand.Read(key)
+
+	return &SCRAMCredentials{
+		Salt:       hmacSHA256(secret, username)[:16],
+		Iterations: SCRAMIterations,
+		StoredKey:  key,
+		ServerKey:  key,
+	}
+}
+
+// scramAttrs parses a comma separated list of key=value attributes.
+func scramAttrs(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, field := range strings.Split(msg, ",") {
+		if k, v, ok := strings.Cut(field, "="); ok && len(k) == 1 {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
+
+// scramUnescape decodes the =2C and =3D escapes of a SCRAM username.
+func scramUnescape(name string) (string, error) {
+	if name == "" {
+		return "", errMalformedAuth
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '=' {
+			b.WriteByte(name[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(name[i:], "=2C"):
+			b.WriteByte(',')
+		case strings.HasPrefix(name[i:], "=3D"):
+			b.WriteByte('=')
+		default:
+			return "", errMalformedAuth
+		}
+		i += 2
+	}
+	return b.String(), nil
+}
+
+func hmacSHA256(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
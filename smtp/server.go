@@ -0,0 +1,330 @@
+package smtp
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// drainTimeout bounds how long Shutdown waits for sessions to go away after
+// telling them to, before closing them outright.
+const drainTimeout = 10 * time.Second
+
+// Server accepts SMTP connections and hands every transaction to Backend.
+type Server struct {
+	// Addr is the TCP address ListenAndServe listens on.
+	Addr string
+	// TLSAddr is the TCP address ListenAndServeTLS listens on for
+	// implicit TLS connections.
+	TLSAddr string
+	// Domain is the host name announced in the greeting.
+	Domain  string
+	Backend Backend
+
+	// TLSConfig enables STARTTLS and implicit TLS when set.
+	TLSConfig *tls.Config
+	// AuthRequired makes MAIL, RCPT and DATA fail until the client has
+	// authenticated, as on a submission port. An inbound MX leaves it off
+	// and lets the backend restrict recipients instead.
+	AuthRequired bool
+	// AuthRequiresTLS refuses AUTH on connections that are not encrypted.
+	AuthRequiresTLS bool
+	// MaxRecipients caps RCPT commands per transaction, 0 means no limit.
+	MaxRecipients int
+	// MaxMessageBytes caps the size of a message and is advertised with
+	// SIZE, 0 means no limit.
+	MaxMessageBytes int64
+	// Extensions are the optional ESMTP extensions on offer.
+	Extensions Extensions
+
+	// Timeouts bound how long sessions wait for the client.
+	Timeouts Timeouts
+	// MaxLineLength caps command lines, CRLF included; longer ones are
+	// answered with 500. RFC 5321 asks for at least 512, DSN parameters
+	// need more. 0 means no limit.
+	MaxLineLength int
+	// MaxErrors closes a session after that many 5xx replies, 0 means no
+	// limit.
+	MaxErrors int
+	// MaxConns and MaxConnsPerIP cap the open sessions in total and from
+	// one client address. Connections over either are answered 421 and
+	// closed. 0 means no limit.
+	MaxConns      int
+	MaxConnsPerIP int
+	// GreetingDelay holds back the greeting and turns away clients that
+	// talk before it, 0 greets at once. Meant for an inbound MX.
+	GreetingDelay time.Duration
+	// SCRAMSecret keys the salts SCRAM-SHA-256 makes up for unknown users.
+	// Give every server of a deployment the same secret, kept across
+	// restarts, so a name always gets the same salt. NewServer sets a
+	// random one.
+	SCRAMSecret []byte
+
+	mu        sync.Mutex
+	auths     map[string]SASLMechanism
+	listeners []net.Listener
+	conns     map[*Conn]struct{}
+	perIP     map[string]int
+	closed    bool
+}
+
+func NewServer(be Backend) *Server {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+
+	return &Server{
+		Addr:            ":25",
+		TLSAddr:         ":465",
+		Domain:          "localhost",
+		Backend:         be,
+		AuthRequired:    true,
+		MaxRecipients:   100,
+		MaxMessageBytes: 25 << 20,
+		Extensions:      AllExtensions,
+		Timeouts:        DefaultTimeouts,
+		MaxLineLength:   2048,
+		MaxErrors:       20,
+		MaxConns:        1000,
+		MaxConnsPerIP:   20,
+		SCRAMSecret:     secret,
+		auths: map[string]SASLMechanism{
+			"PLAIN": PlainMechanism,
+			"LOGIN": LoginMechanism,
+		},
+		conns: make(map[*Conn]struct{}),
+		perIP: make(map[string]int),
+	}
+}
+
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// ListenAndServeTLS listens on TLSAddr and serves connections that start
+// with a TLS handshake, as on port 465.
+func (s *Server) ListenAndServeTLS() error {
+	l, err := net.Listen("tcp", s.TLSAddr)
+	if err != nil {
+		return err
+	}
+
+	return s.ServeTLS(l)
+}
+
+// Serve accepts connections on l until the server is closed.
+func (s *Server) Serve(l net.Listener) error {
+	return s.serve(l, false)
+}
+
+// ServeTLS is like Serve, but wraps every accepted connection in TLS
+// using TLSConfig.
+func (s *Server) ServeTLS(l net.Listener) error {
+	if s.TLSConfig == nil {
+		return errors.New("smtp: ServeTLS requires TLSConfig")
+	}
+
+	return s.serve(l, true)
+}
+
+func (s *Server) serve(l net.Listener, implicitTLS bool) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners = append(s.listeners, l)
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() || errors.Is(err, net.ErrClosed) {
+				return ErrServerClosed
+			}
+			log.Println(err)
+			continue
+		}
+		c := newConn(conn, s)
+		if implicitTLS {
+			c.setConn(tls.Server(conn, s.TLSConfig))
+		}
+
+		// Registered before the goroutine starts, so Shutdown cannot miss
+		// a connection that was just accepted.
+		if !s.track(c) {
+			go s.refuse(conn, implicitTLS)
+			continue
+		}
+		go s.handleConn(c)
+	}
+}
+
+// track registers c as open, unless that would exceed MaxConns or
+// MaxConnsPerIP.
+func (s *Server) track(c *Conn) bool {
+	ip := remoteHost(c.raw)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.MaxConns > 0 && len(s.conns) >= s.MaxConns {
+		return false
+	}
+	if s.MaxConnsPerIP > 0 && s.perIP[ip] >= s.MaxConnsPerIP {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	s.perIP[ip]++
+	return true
+}
+
+func (s *Server) untrack(c *Conn) {
+	ip := remoteHost(c.raw)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, c)
+	if s.perIP[ip]--; s.perIP[ip] <= 0 {
+		delete(s.perIP, ip)
+	}
+}
+
+// refuse turns away a connection over the limits. An implicit TLS client
+// cannot read a plaintext reply, so it is just closed.
+func (s *Server) refuse(conn net.Conn, implicitTLS bool) {
+	defer conn.Close()
+	if implicitTLS {
+		return
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprintf(conn, "421 4.7.0 %s Too many connections, try again later\r\n", s.Domain)
+}
+
+func remoteHost(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+func (s *Server) handleConn(c *Conn) {
+	defer s.untrack(c)
+
+	c.serve()
+}
+
+// Close stops all listeners and closes every open connection.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrServerClosed
+	}
+
+	err := s.closeListenersLocked()
+	for c := range s.conns {
+		c.raw.Close()
+	}
+
+	return err
+}
+
+// Shutdown stops accepting connections and lets open sessions carry on
+// until they quit or ctx is done. Sessions still open then are answered
+// 421 on their next command, idle ones at once, and closed; any left after
+// drainTimeout are cut off. It returns ctx.Err() if sessions had to be
+// ended.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	err := s.closeListenersLocked()
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+wait:
+	for s.numConns() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			break wait
+		}
+	}
+	if s.numConns() == 0 {
+		return err
+	}
+
+	s.mu.Lock()
+	for c := range s.conns {
+		c.drain()
+	}
+	s.mu.Unlock()
+
+	deadline := time.Now().Add(drainTimeout)
+	for s.numConns() > 0 && time.Now().Before(deadline) {
+		<-ticker.C
+	}
+
+	s.mu.Lock()
+	for c := range s.conns {
+		c.raw.Close()
+	}
+	s.mu.Unlock()
+
+	return ctx.Err()
+}
+
+func (s *Server) closeListenersLocked() error {
+	s.closed = true
+
+	var err error
+	for _, l := range s.listeners {
+		if lerr := l.Close(); lerr != nil && !errors.Is(lerr, net.ErrClosed) && err == nil {
+			err = lerr
+		}
+	}
+	s.listeners = nil
+
+	return err
+}
+
+// SetMessageLimits changes MaxRecipients and MaxMessageBytes of a running
+// server. Open sessions apply them from their next command on.
+func (s *Server) SetMessageLimits(maxRecipients int, maxMessageBytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.MaxRecipients, s.MaxMessageBytes = maxRecipients, maxMessageBytes
+}
+
+func (s *Server) messageLimits() (int, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.MaxRecipients, s.MaxMessageBytes
+}
+
+func (s *Server) numConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
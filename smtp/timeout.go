@@ -0,0 +1,68 @@
+package smtp
+
+import (
+	"time"
+)
+
+// Timeouts bound how long a session waits for the client, following the
+// server side of RFC 5321 section 4.5.3.2. A zero value means no limit.
+type Timeouts struct {
+	// Greeting is the time from accepting a connection, including any
+	// implicit TLS handshake, to receiving the first command.
+	Greeting time.Duration
+	// Command is the time allowed for each further command line, SASL
+	// response and reply.
+	Command time.Duration
+	// DataBlock is the longest wait for the next piece of message content.
+	DataBlock time.Duration
+	// DataTermination caps the whole transfer from the 354 reply to the
+	// final ".", so a client trickling data cannot keep the session open
+	// indefinitely.
+	DataTermination time.Duration
+}
+
+// DefaultTimeouts are the values RFC 5321 recommends.
+var DefaultTimeouts = Timeouts{
+	Greeting:        5 * time.Minute,
+	Command:         5 * time.Minute,
+	DataBlock:       3 * time.Minute,
+	DataTermination: 10 * time.Minute,
+}
+
+// connReader is what the bufio.Reader of a Conn reads from. It renews the
+// read deadline before every read, so block bounds each wait for the
+// client, but never beyond limit.
+type connReader struct {
+	c     *Conn
+	block time.Duration
+	limit time.Time
+}
+
+// expect sets the timeouts for the reads that follow: each one may wait at
+// most block, all of them together at most total. Zero means no limit.
+func (r *connReader) expect(block, total time.Duration) {
+	r.block = block
+	r.limit = time.Time{}
+	if total > 0 {
+		r.limit = time.Now().Add(total)
+	}
+}
+
+func (r *connReader) Read(p []byte) (int, error) {
+	var deadline time.Time
+	if r.block > 0 {
+		deadline = time.Now().Add(r.block)
+	}
+	if !r.limit.IsZero() && (deadline.IsZero() || r.limit.Before(deadline)) {
+		deadline = r.limit
+	}
+	r.c.conn.SetReadDeadline(deadline)
+
+	// drain may have looked for an idle session just before the deadline
+	// above replaced its own; see Conn.drain.
+	if r.c.idle.Load() && r.c.draining.Load() {
+		r.c.conn.SetReadDeadline(time.Now())
+	}
+
+	return r.c.conn.Read(p)
+}
@@ -0,0 +1,102 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertReloader serves a certificate/key pair from disk and reloads it when
+// either file changes, so renewed certificates are picked up without a
+// restart.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if _, err := r.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// GetCertificate is meant for tls.Config.GetCertificate. If reloading a
+// changed pair fails, the previous certificate keeps being served.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTime, err := r.latestModTime()
+	if err != nil && r.cert == nil {
+		return nil, err
+	}
+	if r.cert != nil && (err != nil || !modTime.After(r.modTime)) {
+		return r.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert != nil {
+			return r.cert, nil
+		}
+		return nil, err
+	}
+
+	r.cert = &cert
+	r.modTime = modTime
+	return r.cert, nil
+}
+
+// SetFiles switches r to another certificate/key pair. The new pair is
+// loaded at once; if that fails, r keeps serving the old one.
+func (r *CertReloader) SetFiles(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.certFile, r.keyFile = certFile, keyFile
+	r.cert = &cert
+	// Handshakes reload the new pair only once it changes on disk. If the
+	// files cannot be looked at now, the zero time has the next handshake
+	// try again.
+	r.modTime, _ = r.latestModTime()
+	return nil
+}
+
+// TLSConfig returns a server configuration backed by r.
+func (r *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+}
+
+func (r *CertReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+
+	return latest, nil
+}
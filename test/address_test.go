@@ -0,0 +1,87 @@
+package main_test
+
+import (
+	"testing"
+
+	"smtp-server/smtp"
+)
+
+// ─────────────────────────────────────────────
+// Envelope paths
+// ─────────────────────────────────────────────
+
+func TestAddress_ForwardPaths(t *testing.T) {
+	cases := []struct {
+		path, code, want string
+	}{
+		{"<bob@example.org>", "250", "bob@example.org"},
+		{"<@relay.example,@hop.example:bob@example.org>", "250", "bob@example.org"},
+		{`<"bob"@example.org>`, "250", "bob@example.org"},
+		{`<"bob smith>"@example.org>`, "250", `"bob smith>"@example.org`},
+		{"<bob@[192.0.2.1]>", "250", "bob@[192.0.2.1]"},
+		{"<bob@[IPv6:2001:db8::1]>", "250", "bob@[IPv6:2001:db8::1]"},
+		{"<Postmaster>", "250", smtp.Postmaster},
+		{"<POSTMASTER>", "250", smtp.Postmaster},
+		{"bob@example.org", "501", ""},
+		{"<bob@example.org", "501", ""},
+		{"<>", "501", ""},
+		{"<bob>", "553", ""},
+		{"<bob@>", "553", ""},
+		{"<bob..smith@example.org>", "553", ""},
+		{"<bob@-example.org>", "553", ""},
+		{"<bob@[300.0.0.1]>", "553", ""},
+		{"<bøb@example.org>", "553", ""},
+		{"<bob@bücher.example>", "553", ""},
+	}
+
+	for _, tc := range cases {
+		be := &memBackend{}
+		srv := smtp.NewServer(be)
+		srv.AuthRequired = false
+		srv.Domain = "mx.example.com"
+		addr := startServer(t, srv)
+		conn, r, w := dialServer(t, addr)
+
+		send(t, w, "EHLO client.example.com")
+		readReply(t, r)
+		send(t, w, "MAIL FROM:<>")
+		assertCode(t, readLine(t, r), "250")
+		send(t, w, "RCPT TO:"+tc.path)
+		if got := readLine(t, r); got[:3] != tc.code {
+			t.Errorf("%s: got %q, want %s", tc.path, got, tc.code)
+			continue
+		}
+		if tc.code != "250" {
+			continue
+		}
+
+		send(t, w, "DATA")
+		assertCode(t, readLine(t, r), "354")
+		conn.Write([]byte("Subject: x\r\n\r\n.\r\n"))
+		assertCode(t, readLine(t, r), "250")
+		if msgs := be.Messages(); len(msgs) != 1 || msgs[0].To[0] != tc.want {
+			t.Errorf("%s: backend got %+v, want %s", tc.path, msgs, tc.want)
+		}
+	}
+}
+
+func TestAddress_ReversePaths(t *testing.T) {
+	srv := smtp.NewServer(&memBackend{})
+	srv.AuthRequired = false
+	addr := startServer(t, srv)
+	_, r, w := dialServer(t, addr)
+
+	send(t, w, "EHLO client.example.com")
+	readReply(t, r)
+
+	send(t, w, "MAIL FROM:<alice@example.com")
+	assertCode(t, readLine(t, r), "501")
+	send(t, w, "MAIL FROM:<alice@exa_mple.com>")
+	line := readLine(t, r)
+	assertCode(t, line, "553")
+	if line[4:9] != "5.1.7" {
+		t.Errorf("expected 5.1.7 for a bad sender, got %q", line)
+	}
+	send(t, w, "MAIL FROM:<alice@example.com>")
+	assertCode(t, readLine(t, r), "250")
+}
@@ -0,0 +1,217 @@
+package main_test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"smtp-server/smtp"
+)
+
+// sendChunk writes a BDAT command followed by its chunk.
+func sendChunk(t *testing.T, conn net.Conn, chunk string, last bool) {
+	t.Helper()
+	cmd := fmt.Sprintf("BDAT %d", len(chunk))
+	if last {
+		cmd += " LAST"
+	}
+	if _, err := conn.Write([]byte(cmd + "\r\n" + chunk)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startTransaction greets the server and sends MAIL and RCPT.
+func startTransaction(t *testing.T, r *bufio.Reader, w *bufio.Writer, mail string) {
+	t.Helper()
+	send(t, w, "EHLO client.example.com")
+	readReply(t, r)
+	send(t, w, mail)
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "RCPT TO:<bob@example.com>")
+	assertCode(t, readLine(t, r), "250")
+}
+
+// ─────────────────────────────────────────────
+// CHUNKING and BINARYMIME
+// ─────────────────────────────────────────────
+
+func TestChunking_Advertised(t *testing.T) {
+	_, r, w := dialServer(t, startServer(t, limitedServer()))
+
+	send(t, w, "EHLO client.example.com")
+	exts := strings.Join(readReply(t, r), "\n")
+	for _, ext := range []string{"CHUNKING", "BINARYMIME"} {
+		if !strings.Contains(exts, ext) {
+			t.Errorf("%s not advertised: %q", ext, exts)
+		}
+	}
+}
+
+func TestChunking_DeliversChunksVerbatim(t *testing.T) {
+	be := &memBackend{}
+	srv := limitedServer()
+	srv.Backend = be
+	conn, r, w := dialServer(t, startServer(t, srv))
+
+	startTransaction(t, r, w, "MAIL FROM:<alice@example.com> BODY=BINARYMIME")
+	// Binary content is taken as it is: no dot-stuffing, no line endings
+	// to fix up.
+	chunks := []string{"Subject: bin\r\n\r\n", ".\r\n\x00\xff", "bare\nlf"}
+	sendChunk(t, conn, chunks[0], false)
+	assertCode(t, readLine(t, r), "250")
+	sendChunk(t, conn, chunks[1], false)
+	assertCode(t, readLine(t, r), "250")
+	sendChunk(t, conn, chunks[2], true)
+	assertCode(t, readLine(t, r), "250")
+
+	send(t, w, "NOOP")
+	assertCode(t, readLine(t, r), "250")
+
+	msgs := be.Messages()
+	if len(msgs) != 1 || msgs[0].Data != strings.Join(chunks, "") {
+		t.Fatalf("unexpected messages: %+v", msgs)
+	}
+	if msgs[0].MailOpts.Body != smtp.BodyBinaryMIME {
+		t.Errorf("BODY = %q, want BINARYMIME", msgs[0].MailOpts.Body)
+	}
+}
+
+func TestChunking_RefusedChunkIsSkipped(t *testing.T) {
+	srv := limitedServer()
+	conn, r, w := dialServer(t, startServer(t, srv))
+
+	send(t, w, "EHLO client.example.com")
+	readReply(t, r)
+	// The chunk looks like a command, but must be read as data and
+	// discarded, not executed.
+	sendChunk(t, conn, "QUIT\r\n", true)
+	assertCode(t, readLine(t, r), "503")
+	send(t, w, "NOOP")
+	assertCode(t, readLine(t, r), "250")
+}
+
+func TestChunking_DataDuringTransferRefused(t *testing.T) {
+	be := &memBackend{}
+	srv := limitedServer()
+	srv.Backend = be
+	conn, r, w := dialServer(t, startServer(t, srv))
+
+	startTransaction(t, r, w, "MAIL FROM:<alice@example.com>")
+	sendChunk(t, conn, "Subject: x\r\n", false)
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "DATA")
+	assertCode(t, readLine(t, r), "503")
+
+	sendChunk(t, conn, "\r\nbody\r\n", true)
+	assertCode(t, readLine(t, r), "250")
+	if msgs := be.Messages(); len(msgs) != 1 || msgs[0].Data != "Subject: x\r\n\r\nbody\r\n" {
+		t.Errorf("unexpected messages: %+v", msgs)
+	}
+}
+
+func TestChunking_BinaryMIMENeedsBdat(t *testing.T) {
+	_, r, w := dialServer(t, startServer(t, limitedServer()))
+
+	startTransaction(t, r, w, "MAIL FROM:<alice@example.com> BODY=BINARYMIME")
+	send(t, w, "DATA")
+	assertCode(t, readLine(t, r), "503")
+}
+
+func TestChunking_UnknownBodyRejected(t *testing.T) {
+	_, r, w := dialServer(t, startServer(t, limitedServer()))
+
+	send(t, w, "EHLO client.example.com")
+	readReply(t, r)
+	send(t, w, "MAIL FROM:<alice@example.com> BODY=UTF16")
+	assertCode(t, readLine(t, r), "501")
+}
+
+func TestChunking_SizeLimitAcrossChunks(t *testing.T) {
+	be := &memBackend{}
+	srv := limitedServer()
+	srv.Backend = be
+	srv.MaxMessageBytes = 100
+	conn, r, w := dialServer(t, startServer(t, srv))
+
+	startTransaction(t, r, w, "MAIL FROM:<alice@example.com>")
+	sendChunk(t, conn, strings.Repeat("a", 60), false)
+	assertCode(t, readLine(t, r), "250")
+	sendChunk(t, conn, strings.Repeat("b", 60), true)
+	assertCode(t, readLine(t, r), "552")
+
+	// The transaction is over, the session is not.
+	send(t, w, "NOOP")
+	assertCode(t, readLine(t, r), "250")
+	if msgs := be.Messages(); len(msgs) != 0 {
+		t.Errorf("oversized message stored: %+v", msgs)
+	}
+}
+
+func TestChunking_BadSizeCloses(t *testing.T) {
+	conn, r, w := dialServer(t, startServer(t, limitedServer()))
+
+	send(t, w, "EHLO client.example.com")
+	readReply(t, r)
+	send(t, w, "BDAT lots")
+	assertCode(t, readLine(t, r), "501")
+	assertClosed(t, conn, r)
+}
+
+func TestChunking_RsetAbortsTransfer(t *testing.T) {
+	be := &memBackend{}
+	srv := limitedServer()
+	srv.Backend = be
+	conn, r, w := dialServer(t, startServer(t, srv))
+
+	startTransaction(t, r, w, "MAIL FROM:<alice@example.com>")
+	sendChunk(t, conn, "Subject: x\r\n", false)
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "RSET")
+	assertCode(t, readLine(t, r), "250")
+
+	// A BDAT now belongs to no transaction.
+	sendChunk(t, conn, "body\r\n", true)
+	assertCode(t, readLine(t, r), "503")
+	if msgs := be.Messages(); len(msgs) != 0 {
+		t.Errorf("aborted message stored: %+v", msgs)
+	}
+}
+
+// ─────────────────────────────────────────────
+// Outbound client
+// ─────────────────────────────────────────────
+
+func TestClient_SendsBinaryWithBdat(t *testing.T) {
+	be := &memBackend{}
+	srv := limitedServer()
+	srv.Backend = be
+	addr := startServer(t, srv)
+
+	c, err := smtp.Dial(addr, smtp.DefaultClientTimeouts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Hello("client.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail("alice@example.com", &smtp.MailOptions{Body: smtp.BodyBinaryMIME}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("bob@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	// Big enough to take more than one chunk.
+	body := "Subject: bin\r\n\r\n" + strings.Repeat(".\n\x00", 500000)
+	if _, err := c.Data(strings.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+
+	if msgs := be.Messages(); len(msgs) != 1 || msgs[0].Data != body {
+		t.Errorf("binary content not delivered verbatim (%d messages)", len(msgs))
+	}
+}
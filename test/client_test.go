@@ -0,0 +1,107 @@
+package main_test
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+
+	"smtp-server/smtp"
+)
+
+// ─────────────────────────────────────────────
+// Outbound client
+// ─────────────────────────────────────────────
+
+func TestClient_DeliversWithDotStuffing(t *testing.T) {
+	be := &memBackend{}
+	srv := smtp.NewServer(be)
+	srv.AuthRequired = false
+	addr := startServer(t, srv)
+
+	c, err := smtp.Dial(addr, smtp.DefaultClientTimeouts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Hello("client.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, size := c.Extension("SIZE"); !ok || size == "" {
+		t.Errorf("SIZE extension not parsed: %v %q", ok, size)
+	}
+	if err := c.Mail("alice@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("bob@myserver.local"); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := c.Data(strings.NewReader("Subject: x\n\n.hidden\r\nlast"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(reply, "250") {
+		t.Errorf("unexpected final reply %q", reply)
+	}
+	c.Quit()
+
+	want := "Subject: x\r\n\r\n.hidden\r\nlast\r\n"
+	if msgs := be.Messages(); len(msgs) != 1 || msgs[0].Data != want {
+		t.Errorf("got %+v, want %q", msgs, want)
+	}
+}
+
+func TestClient_TypedErrors(t *testing.T) {
+	addr := startServer(t, smtp.NewServer(&memBackend{}))
+
+	c, err := smtp.Dial(addr, smtp.DefaultClientTimeouts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Hello("client.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The submission server refuses MAIL without AUTH: a permanent 530.
+	err = c.Mail("alice@example.com", nil)
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok || smtpErr.Code != 530 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 7, 0}) {
+		t.Fatalf("expected 530 5.7.0, got %v", err)
+	}
+	if !smtp.IsPermanent(err) || smtpErr.Temporary() {
+		t.Errorf("530 must be permanent")
+	}
+}
+
+func TestClient_StartTLS(t *testing.T) {
+	srv := tlsServer(t)
+	srv.AuthRequired = false
+	addr := startServer(t, srv)
+
+	c, err := smtp.Dial(addr, smtp.DefaultClientTimeouts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Hello("client.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		t.Fatal("STARTTLS not advertised")
+	}
+
+	if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+	state, ok := c.TLSConnectionState()
+	if !ok || state.Version < tls.VersionTLS12 {
+		t.Fatalf("unexpected TLS state %v %x", ok, state.Version)
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		t.Error("STARTTLS still advertised after upgrade")
+	}
+	if err := c.Mail("alice@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,232 @@
+package main_test
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"smtp-server/config"
+)
+
+// writeConfig writes content to a file called name in a temporary
+// directory and returns its path.
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// ─────────────────────────────────────────────
+// Loading
+// ─────────────────────────────────────────────
+
+func TestConfig_ExampleMatchesDefaults(t *testing.T) {
+	c, err := config.Load("../config.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := config.Default()
+	want.Hostname = "mail.example.com"
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("example config differs from the defaults:\n got %+v\nwant %+v", c, want)
+	}
+}
+
+func TestConfig_LoadYAMLAndTOML(t *testing.T) {
+	files := map[string]string{
+		"smtp.yaml": `
+hostname: mx.example.com
+local_domains: [Example.COM, example.net]
+auth:
+  lockout: 1m
+delivery:
+  retry_schedule: [30s, 10m]
+  tls_policies: {Example.ORG: verify}
+`,
+		"smtp.toml": `
+hostname = "mx.example.com"
+local_domains = ["Example.COM", "example.net"]
+
+[auth]
+lockout = "1m"
+
+[delivery]
+retry_schedule = ["30s", "10m"]
+tls_policies = { "Example.ORG" = "verify" }
+`,
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			c, err := config.Load(writeConfig(t, name, content))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if c.Hostname != "mx.example.com" {
+				t.Errorf("hostname: %q", c.Hostname)
+			}
+			if !c.IsLocalDomain("EXAMPLE.com") || c.IsLocalDomain("example.org") {
+				t.Errorf("local domains: %v", c.LocalDomains)
+			}
+			if c.Auth.Lockout != time.Minute || c.Auth.MaxFails != 5 {
+				t.Errorf("auth: %+v", c.Auth)
+			}
+			if want := []time.Duration{30 * time.Second, 10 * time.Minute}; !reflect.DeepEqual(c.Delivery.RetrySchedule, want) {
+				t.Errorf("retry schedule: %v", c.Delivery.RetrySchedule)
+			}
+			if c.Delivery.TLSPolicies["example.org"] != "verify" {
+				t.Errorf("TLS policies: %v", c.Delivery.TLSPolicies)
+			}
+		})
+	}
+}
+
+func TestConfig_UnknownSettingRejected(t *testing.T) {
+	for name, content := range map[string]string{
+		"smtp.yaml": "smtp:\n  adr: \":25\"\n",
+		"smtp.toml": "[smtp]\nadr = \":25\"\n",
+		"smtp.ini":  "",
+	} {
+		if _, err := config.Load(writeConfig(t, name, content)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestConfig_PrecedenceFileEnvFlags(t *testing.T) {
+	path := writeConfig(t, "smtp.yaml", "smtp:\n  addr: \":2525\"\n  mx_addr: \":2526\"\nhttp:\n  addr: \":9001\"\n")
+	t.Setenv("SMTP_MX_ADDR", ":2527")
+	t.Setenv("HTTP_ADDR", ":9002")
+	t.Setenv("SMTP_DOMAIN_RATE", "*=60,Gmail.com=30")
+	t.Setenv("SMTP_MAX_MESSAGE_SIZE", "1048576")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := config.RegisterFlags(fs)
+	if err := fs.Parse([]string{"-config", path, "-http-addr", ":9003", "-allow-insecure-auth", "-max-recipients", "10"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := flags.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.SMTP.Addr != ":2525" || c.SMTP.MXAddr != ":2527" || c.HTTP.Addr != ":9003" {
+		t.Errorf("addresses: smtp %q, mx %q, http %q", c.SMTP.Addr, c.SMTP.MXAddr, c.HTTP.Addr)
+	}
+	if !c.SMTP.TLS.AllowInsecureAuth {
+		t.Error("boolean flag not applied")
+	}
+	if c.DomainRate("gmail.com") != 30 || c.DomainRate("example.com") != 60 {
+		t.Errorf("domain rates: %v", c.Delivery.DomainRates)
+	}
+	if c.SMTP.MaxRecipients != 10 || c.SMTP.MaxMessageSize != 1<<20 {
+		t.Errorf("message limits: %d recipients, %d bytes", c.SMTP.MaxRecipients, c.SMTP.MaxMessageSize)
+	}
+}
+
+// ─────────────────────────────────────────────
+// Validation
+// ─────────────────────────────────────────────
+
+func TestConfig_ValidateReportsEveryProblem(t *testing.T) {
+	c := config.Default()
+	c.Hostname = "mx.example.com"
+	c.LocalDomains = []string{"bad domain"}
+	c.SMTP.Addr = "8000"
+	c.SMTP.TLS.Cert = "/nonexistent/cert.pem"
+	c.Auth.MaxFails = 0
+	c.Delivery.Workers = 0
+	c.Delivery.TLSPolicies = map[string]string{"example.org": "always"}
+	c.SMTP.MaxMessageSize = -1
+
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("expected validation to fail")
+	}
+	for _, want := range []string{"local_domains", "smtp.addr", "smtp.tls", "auth.max_fails", "delivery.workers", "tls_policies", "smtp.max_message_size"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not mention %s: %v", want, err)
+		}
+	}
+}
+
+func TestConfig_Postmaster(t *testing.T) {
+	c, err := config.Load(writeConfig(t, "smtp.yaml", "hostname: mx.example.com\nlocal_domains: [example.com, example.net]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.PostmasterAddress(); got != "postmaster@example.com" {
+		t.Errorf("default postmaster %q", got)
+	}
+
+	c.Postmaster = "hostmaster@Example.NET"
+	if err := c.Validate(); err != nil {
+		t.Errorf("local postmaster refused: %v", err)
+	}
+	c.Postmaster = "postmaster@example.org"
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "postmaster") {
+		t.Errorf("expected a postmaster outside local_domains to be refused, got %v", err)
+	}
+}
+
+func TestConfig_BadEnvironmentValue(t *testing.T) {
+	t.Setenv("SMTP_MAX_QUEUE_AGE", "five days")
+	if _, err := config.Load(""); err == nil || !strings.Contains(err.Error(), "SMTP_MAX_QUEUE_AGE") {
+		t.Errorf("expected an error naming SMTP_MAX_QUEUE_AGE, got %v", err)
+	}
+}
+
+// ─────────────────────────────────────────────
+// Reload
+// ─────────────────────────────────────────────
+
+func TestConfig_ReloadAppliesOnlyLiveSettings(t *testing.T) {
+	current := config.Default()
+	current.Hostname = "mx.example.com"
+
+	next := *current
+	next.LocalDomains = []string{"example.com"}
+	next.Auth.IPLimit = 100
+	next.Delivery.DomainRates = map[string]int{"*": 10}
+	next.SMTP.MaxRecipients = 5
+	next.SMTP.MaxMessageSize = 1 << 20
+
+	c, restart := current.Reload(&next)
+	if restart {
+		t.Error("reloadable changes reported as needing a restart")
+	}
+	if !c.IsLocalDomain("example.com") || c.Auth.IPLimit != 100 || c.DomainRate("x.org") != 10 ||
+		c.SMTP.MaxRecipients != 5 || c.SMTP.MaxMessageSize != 1<<20 {
+		t.Errorf("reloadable settings not taken: %+v", c)
+	}
+
+	next.SMTP.Addr = ":2525"
+	next.Delivery.Workers = 2
+	c, restart = current.Reload(&next)
+	if !restart {
+		t.Error("changed listener and workers not reported")
+	}
+	if c.SMTP.Addr != ":8000" || c.Delivery.Workers != 8 {
+		t.Errorf("restart-only settings were changed live: addr %q, workers %d", c.SMTP.Addr, c.Delivery.Workers)
+	}
+}
+
+func TestConfig_ReloadDoesNotToggleTLS(t *testing.T) {
+	current := config.Default()
+	next := *current
+	next.SMTP.TLS.Cert, next.SMTP.TLS.Key = "cert.pem", "key.pem"
+
+	c, restart := current.Reload(&next)
+	if !restart || c.SMTP.TLS.Enabled() {
+		t.Errorf("enabling TLS should need a restart: restart %v, tls %+v", restart, c.SMTP.TLS)
+	}
+}
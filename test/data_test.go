@@ -0,0 +1,121 @@
+package main_test
+
+import (
+	"strings"
+	"testing"
+
+	"smtp-server/smtp"
+)
+
+// ─────────────────────────────────────────────
+// DATA content and SIZE
+// ─────────────────────────────────────────────
+
+func TestData_PreservesBytesAndUnstuffsDots(t *testing.T) {
+	be := &memBackend{}
+	addr := startServer(t, smtp.NewServer(be))
+	conn, r, w := dialServer(t, addr)
+	memLogin(t, r, w)
+
+	send(t, w, "MAIL FROM:<alice@example.com>")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "RCPT TO:<bob@example.org>")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "DATA")
+	assertCode(t, readLine(t, r), "354")
+	conn.Write([]byte("Subject: folded\r\n  header  \r\n\r\n..leading dot\r\n.\r\n"))
+	assertCode(t, readLine(t, r), "250")
+
+	want := "Subject: folded\r\n  header  \r\n\r\n.leading dot\r\n"
+	if msgs := be.Messages(); len(msgs) != 1 || msgs[0].Data != want {
+		t.Errorf("got %+v, want %q", msgs, want)
+	}
+}
+
+func TestData_SizeLimit(t *testing.T) {
+	srv := smtp.NewServer(&memBackend{})
+	srv.MaxMessageBytes = 64
+	addr := startServer(t, srv)
+	_, r, w := dialServer(t, addr)
+	memLogin(t, r, w)
+
+	send(t, w, "EHLO client.example.com")
+	if exts := strings.Join(readReply(t, r), "\n"); !strings.Contains(exts, "SIZE 64") {
+		t.Errorf("SIZE not advertised: %q", exts)
+	}
+
+	send(t, w, "MAIL FROM:<alice@example.com> SIZE=65")
+	assertCode(t, readLine(t, r), "552")
+
+	send(t, w, "MAIL FROM:<alice@example.com> SIZE=10")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "RCPT TO:<bob@example.org>")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "DATA")
+	assertCode(t, readLine(t, r), "354")
+	send(t, w, strings.Repeat("x", 100))
+	send(t, w, ".")
+	assertCode(t, readLine(t, r), "552")
+
+	// The session must be usable after the oversized message was drained.
+	send(t, w, "NOOP")
+	assertCode(t, readLine(t, r), "250")
+}
+
+func TestData_ParamsRequireEhlo(t *testing.T) {
+	addr := startServer(t, smtp.NewServer(&memBackend{}))
+	_, r, w := dialServer(t, addr)
+	memLogin(t, r, w)
+
+	send(t, w, "MAIL FROM:<alice@example.com> SIZE=10")
+	assertCode(t, readLine(t, r), "555")
+}
+
+func TestData_BareLFDotDoesNotEndMessage(t *testing.T) {
+	be := &memBackend{}
+	addr := startServer(t, smtp.NewServer(be))
+	conn, r, w := dialServer(t, addr)
+	memLogin(t, r, w)
+
+	send(t, w, "MAIL FROM:<alice@example.com>")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "RCPT TO:<bob@example.org>")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "DATA")
+	assertCode(t, readLine(t, r), "354")
+
+	// A "." line after a bare LF must not end the message, or the rest
+	// would run as a second transaction with a forged envelope.
+	smuggled := "body\n.\nMAIL FROM:<ceo@bank.com>\r\nRCPT TO:<victim@e.f>\r\nDATA\r\nforged\r\n"
+	conn.Write([]byte(smuggled + ".\r\n"))
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "NOOP")
+	assertCode(t, readLine(t, r), "250")
+
+	msgs := be.Messages()
+	if len(msgs) != 1 || msgs[0].From != "alice@example.com" || msgs[0].Data != smuggled {
+		t.Errorf("got %+v, want one message holding %q", msgs, smuggled)
+	}
+}
+
+func TestData_OnlyCRLFDotCRLFEndsMessage(t *testing.T) {
+	for _, content := range []string{"a\r\n.\nb\r\n", "a\n.\r\nb\r\n", "a\n.\nb\r\n"} {
+		be := &memBackend{}
+		addr := startServer(t, smtp.NewServer(be))
+		conn, r, w := dialServer(t, addr)
+		memLogin(t, r, w)
+
+		send(t, w, "MAIL FROM:<alice@example.com>")
+		assertCode(t, readLine(t, r), "250")
+		send(t, w, "RCPT TO:<bob@example.org>")
+		assertCode(t, readLine(t, r), "250")
+		send(t, w, "DATA")
+		assertCode(t, readLine(t, r), "354")
+		conn.Write([]byte(content + ".\r\n"))
+		assertCode(t, readLine(t, r), "250")
+
+		if msgs := be.Messages(); len(msgs) != 1 || !strings.HasSuffix(msgs[0].Data, "b\r\n") {
+			t.Errorf("%q: got %+v", content, msgs)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main_test
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"smtp-server/smtp"
+)
+
+// ─────────────────────────────────────────────
+// DSN parameters
+// ─────────────────────────────────────────────
+
+func TestDSN_ParametersReachBackend(t *testing.T) {
+	be := &memBackend{}
+	srv := smtp.NewServer(be)
+	srv.AuthRequired = false
+	addr := startServer(t, srv)
+	conn, r, w := dialServer(t, addr)
+
+	send(t, w, "EHLO client.example.com")
+	if exts := strings.Join(readReply(t, r), "\n"); !strings.Contains(exts, "DSN") {
+		t.Errorf("DSN not advertised: %q", exts)
+	}
+
+	send(t, w, "MAIL FROM:<alice@example.com> RET=HDRS ENVID=QQ+2B314")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "RCPT TO:<bob@example.org> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;bob+40example.org")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "RCPT TO:<carol@example.org>")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "DATA")
+	assertCode(t, readLine(t, r), "354")
+	conn.Write([]byte("Subject: x\r\n\r\nbody\r\n.\r\n"))
+	assertCode(t, readLine(t, r), "250")
+
+	msgs := be.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+	mail := msgs[0].MailOpts
+	if mail.Return != smtp.DSNReturnHeaders || mail.EnvelopeID != "QQ+314" {
+		t.Errorf("unexpected MAIL options %+v", mail)
+	}
+	rcpt := msgs[0].RcptOpts[0]
+	if !slices.Equal(rcpt.Notify, []smtp.DSNNotify{smtp.DSNNotifySuccess, smtp.DSNNotifyFailure}) {
+		t.Errorf("unexpected NOTIFY %v", rcpt.Notify)
+	}
+	if rcpt.OriginalRecipientType != "rfc822" || rcpt.OriginalRecipient != "bob@example.org" {
+		t.Errorf("unexpected ORCPT %+v", rcpt)
+	}
+	if msgs[0].RcptOpts[1].Notify != nil {
+		t.Errorf("NOTIFY set without the parameter: %v", msgs[0].RcptOpts[1].Notify)
+	}
+}
+
+func TestDSN_BadParametersRejected(t *testing.T) {
+	srv := smtp.NewServer(&memBackend{})
+	srv.AuthRequired = false
+	addr := startServer(t, srv)
+	_, r, w := dialServer(t, addr)
+
+	send(t, w, "EHLO client.example.com")
+	readReply(t, r)
+
+	send(t, w, "MAIL FROM:<alice@example.com> RET=BODY")
+	assertCode(t, readLine(t, r), "501")
+	send(t, w, "MAIL FROM:<alice@example.com> ENVID=bad+ZZ")
+	assertCode(t, readLine(t, r), "501")
+	send(t, w, "MAIL FROM:<alice@example.com>")
+	assertCode(t, readLine(t, r), "250")
+
+	for _, param := range []string{"NOTIFY=NEVER,SUCCESS", "NOTIFY=SOMETIMES", "ORCPT=bob@example.org"} {
+		send(t, w, "RCPT TO:<bob@example.org> "+param)
+		assertCode(t, readLine(t, r), "501")
+	}
+}
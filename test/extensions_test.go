@@ -0,0 +1,95 @@
+package main_test
+
+import (
+	"strings"
+	"testing"
+
+	"smtp-server/config"
+	"smtp-server/smtp"
+)
+
+// ─────────────────────────────────────────────
+// Extension switches
+// ─────────────────────────────────────────────
+
+func TestExtensions_OffNotAdvertised(t *testing.T) {
+	srv := limitedServer()
+	srv.Extensions = smtp.Extensions{}
+	_, r, w := dialServer(t, startServer(t, srv))
+
+	send(t, w, "EHLO client.example.com")
+	exts := strings.Join(readReply(t, r), "\n")
+	for _, ext := range []string{"PIPELINING", "ENHANCEDSTATUSCODES", "DSN", "8BITMIME", "CHUNKING", "BINARYMIME", "SMTPUTF8"} {
+		if strings.Contains(exts, ext) {
+			t.Errorf("%s advertised while off: %q", ext, exts)
+		}
+	}
+}
+
+func TestExtensions_OffRefusesCommandsAndParameters(t *testing.T) {
+	srv := limitedServer()
+	srv.Extensions = smtp.Extensions{}
+	_, r, w := dialServer(t, startServer(t, srv))
+
+	send(t, w, "EHLO client.example.com")
+	readReply(t, r)
+	for _, cmd := range []string{
+		"MAIL FROM:<alice@example.com> RET=HDRS",
+		"MAIL FROM:<alice@example.com> ENVID=x",
+		"MAIL FROM:<alice@example.com> BODY=8BITMIME",
+		"MAIL FROM:<alice@example.com> SMTPUTF8",
+	} {
+		send(t, w, cmd)
+		if line := readLine(t, r); !strings.HasPrefix(line, "555 ") {
+			t.Errorf("%s: got %q, want 555", cmd, line)
+		}
+	}
+
+	send(t, w, "MAIL FROM:<alice@example.com>")
+	line := readLine(t, r)
+	assertCode(t, line, "250")
+	// Without ENHANCEDSTATUSCODES the text follows the code directly.
+	if strings.HasPrefix(line, "250 2.") {
+		t.Errorf("enhanced code sent while off: %q", line)
+	}
+	send(t, w, "RCPT TO:<bob@example.com> NOTIFY=NEVER")
+	assertCode(t, readLine(t, r), "555")
+	send(t, w, "RCPT TO:<bob@example.com>")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "BDAT 0 LAST")
+	assertCode(t, readLine(t, r), "500")
+}
+
+func TestExtensions_BinaryMIMENeedsChunking(t *testing.T) {
+	srv := limitedServer()
+	srv.Extensions = smtp.AllExtensions
+	srv.Extensions.Chunking = false
+	_, r, w := dialServer(t, startServer(t, srv))
+
+	send(t, w, "EHLO client.example.com")
+	if exts := strings.Join(readReply(t, r), "\n"); strings.Contains(exts, "BINARYMIME") {
+		t.Errorf("BINARYMIME advertised without CHUNKING: %q", exts)
+	}
+	send(t, w, "MAIL FROM:<alice@example.com> BODY=BINARYMIME")
+	assertCode(t, readLine(t, r), "555")
+	send(t, w, "MAIL FROM:<alice@example.com> BODY=8BITMIME")
+	assertCode(t, readLine(t, r), "250")
+
+	path := writeConfig(t, "smtp.yaml", "hostname: mx.example.com\nsmtp:\n  extensions:\n    chunking: false\n")
+	if _, err := config.Load(path); err == nil || !strings.Contains(err.Error(), "binarymime") {
+		t.Errorf("expected binarymime without chunking to be refused, got %v", err)
+	}
+}
+
+func TestExtensions_FromEnvironment(t *testing.T) {
+	t.Setenv("SMTP_EXT_DSN", "false")
+	c, err := config.Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := smtp.AllExtensions
+	want.DSN = false
+	if got := smtp.Extensions(c.SMTP.Extensions); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,327 @@
+package main_test
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"smtp-server/config"
+	"smtp-server/smtp"
+)
+
+// plainServer is a remote that offers only the given EHLO keywords and
+// accepts every command, for testing what the client sends it. Every
+// command line it receives is passed on through the channel.
+func plainServer(t *testing.T, exts ...string) (string, <-chan string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	cmds := make(chan string, 100)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		conn.Write([]byte("220 plain.example.com ESMTP\r\n"))
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmds <- strings.TrimRight(line, "\r\n")
+			switch verb := strings.ToUpper(strings.Fields(line + " x")[0]); verb {
+			case "EHLO":
+				reply := "250-plain.example.com\r\n"
+				for _, ext := range exts {
+					reply += "250-" + ext + "\r\n"
+				}
+				conn.Write([]byte(reply + "250 HELP\r\n"))
+			case "QUIT":
+				conn.Write([]byte("221 Bye\r\n"))
+				return
+			default:
+				conn.Write([]byte("250 OK\r\n"))
+			}
+		}
+	}()
+
+	return l.Addr().String(), cmds
+}
+
+// ─────────────────────────────────────────────
+// 8BITMIME and SMTPUTF8
+// ─────────────────────────────────────────────
+
+func TestIntl_Advertised(t *testing.T) {
+	_, r, w := dialServer(t, startServer(t, limitedServer()))
+
+	send(t, w, "EHLO client.example.com")
+	exts := strings.Join(readReply(t, r), "\n")
+	for _, ext := range []string{"8BITMIME", "SMTPUTF8"} {
+		if !strings.Contains(exts, ext) {
+			t.Errorf("%s not advertised: %q", ext, exts)
+		}
+	}
+}
+
+func TestIntl_UTF8AddressesWithSMTPUTF8(t *testing.T) {
+	be := &memBackend{}
+	srv := limitedServer()
+	srv.Backend = be
+	conn, r, w := dialServer(t, startServer(t, srv))
+
+	send(t, w, "EHLO client.example.com")
+	readReply(t, r)
+	send(t, w, "MAIL FROM:<jörg@bücher.example> SMTPUTF8 BODY=8BITMIME")
+	assertCode(t, readLine(t, r), "250")
+	// Decomposed "ö" comes out composed.
+	send(t, w, "RCPT TO:<jo\u0308rg@example.com>")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "RCPT TO:<\"δοκιμή\"@example.com>")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "DATA")
+	assertCode(t, readLine(t, r), "354")
+	conn.Write([]byte("Subject: Grüße\r\n\r\nGrüße\r\n.\r\n"))
+	assertCode(t, readLine(t, r), "250")
+
+	msgs := be.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("expected one message, got %+v", msgs)
+	}
+	m := msgs[0]
+	if m.From != "jörg@xn--bcher-kva.example" {
+		t.Errorf("From = %q", m.From)
+	}
+	if len(m.To) != 2 || m.To[0] != "jörg@example.com" || m.To[1] != "δοκιμή@example.com" {
+		t.Errorf("To = %q", m.To)
+	}
+	if !m.MailOpts.UTF8 || m.MailOpts.Body != smtp.Body8BitMIME {
+		t.Errorf("MailOpts = %+v", m.MailOpts)
+	}
+	if m.Data != "Subject: Grüße\r\n\r\nGrüße\r\n" {
+		t.Errorf("Data = %q", m.Data)
+	}
+}
+
+func TestIntl_UTF8AddressNeedsSMTPUTF8(t *testing.T) {
+	_, r, w := dialServer(t, startServer(t, limitedServer()))
+
+	send(t, w, "EHLO client.example.com")
+	readReply(t, r)
+	for _, from := range []string{"jörg@example.com", "bob@bücher.example"} {
+		send(t, w, "MAIL FROM:<"+from+">")
+		line := readLine(t, r)
+		assertCode(t, line, "553")
+		if !strings.Contains(line, "5.6.7") {
+			t.Errorf("%s: expected 5.6.7, got %q", from, line)
+		}
+	}
+
+	// SMTPUTF8 lasts for one transaction only.
+	send(t, w, "MAIL FROM:<alice@example.com> SMTPUTF8")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "RSET")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "MAIL FROM:<alice@example.com>")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "RCPT TO:<jörg@example.com>")
+	assertCode(t, readLine(t, r), "553")
+	send(t, w, "RCPT TO:<bob@bücher.example>")
+	assertCode(t, readLine(t, r), "553")
+	// The A-label form needs no SMTPUTF8.
+	send(t, w, "RCPT TO:<bob@xn--bcher-kva.example>")
+	assertCode(t, readLine(t, r), "250")
+}
+
+func TestIntl_BadParametersRejected(t *testing.T) {
+	_, r, w := dialServer(t, startServer(t, limitedServer()))
+
+	send(t, w, "EHLO client.example.com")
+	readReply(t, r)
+	send(t, w, "MAIL FROM:<alice@example.com> SMTPUTF8=yes")
+	assertCode(t, readLine(t, r), "501")
+	send(t, w, "MAIL FROM:<alice@example.com> BODY=9BITMIME")
+	assertCode(t, readLine(t, r), "501")
+}
+
+func TestIntl_ParseAddress(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"bob@example.com", "bob@example.com"},
+		{"Jörg@Bücher.example", "Jörg@xn--bcher-kva.example"},
+		{"jörg@example.com", "jörg@example.com"},
+		{"用户@例子.example", "用户@xn--fsqu00a.example"},
+		{"bob", ""},
+		{"bob@exa_mple.com", ""},
+		{"b..ob@example.com", ""},
+		{"\xffbob@example.com", ""},
+	}
+
+	for _, tc := range cases {
+		got, err := smtp.ParseAddress(tc.in)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", tc.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("%q: got %q, %v; want %q", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+func TestIntl_LocalDomainsInEitherForm(t *testing.T) {
+	path := writeConfig(t, "smtp.yaml", "hostname: mx.example.com\nlocal_domains: [Bücher.example, xn--mnchen-3ya.example]\n")
+	c, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range []string{"xn--bcher-kva.example", "bücher.example", "münchen.example", "XN--MNCHEN-3YA.example"} {
+		if !c.IsLocalDomain(d) {
+			t.Errorf("%s not local", d)
+		}
+	}
+}
+
+// ─────────────────────────────────────────────
+// Outbound client
+// ─────────────────────────────────────────────
+
+func TestClient_SendsSMTPUTF8(t *testing.T) {
+	be := &memBackend{}
+	srv := limitedServer()
+	srv.Backend = be
+	addr := startServer(t, srv)
+
+	c, err := smtp.Dial(addr, smtp.DefaultClientTimeouts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Hello("client.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail("jörg@example.com", &smtp.MailOptions{Body: smtp.Body8BitMIME, UTF8: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("δοκιμή@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Data(strings.NewReader("Subject: Grüße\r\n\r\nhi\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+
+	msgs := be.Messages()
+	if len(msgs) != 1 || !msgs[0].MailOpts.UTF8 || msgs[0].To[0] != "δοκιμή@example.com" {
+		t.Errorf("unexpected messages: %+v", msgs)
+	}
+}
+
+func TestClient_RefusesWhatRemoteLacks(t *testing.T) {
+	cases := []struct {
+		opts *smtp.MailOptions
+		code int
+	}{
+		{&smtp.MailOptions{UTF8: true}, 553},
+		{&smtp.MailOptions{Body: smtp.Body8BitMIME}, 554},
+		{&smtp.MailOptions{Body: smtp.BodyBinaryMIME}, 554},
+	}
+
+	for _, tc := range cases {
+		addr, _ := plainServer(t, "PIPELINING")
+		c, err := smtp.Dial(addr, smtp.DefaultClientTimeouts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Hello("client.example.com"); err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.Mail("alice@example.com", tc.opts)
+		var smtpErr *smtp.SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code != tc.code || !smtp.IsPermanent(err) {
+			t.Errorf("%+v: got %v, want a permanent %d", tc.opts, err, tc.code)
+		}
+		c.Quit()
+		c.Close()
+	}
+}
+
+func TestClient_Downgrade(t *testing.T) {
+	addr, _ := plainServer(t, "CHUNKING")
+	c, err := smtp.Dial(addr, smtp.DefaultClientTimeouts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Hello("client.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	ascii := "Subject: hi\r\n\r\nhello\r\n"
+	cases := []struct {
+		name     string
+		opts     smtp.MailOptions
+		to, body string
+		want     smtp.MailOptions
+	}{
+		// Mail itself leaves BODY=7BIT out for such a server.
+		{"7bit", smtp.MailOptions{Body: smtp.Body7Bit}, "bob@example.com", ascii, smtp.MailOptions{Body: smtp.Body7Bit}},
+		{"8bit ascii", smtp.MailOptions{Body: smtp.Body8BitMIME}, "bob@example.com", ascii, smtp.MailOptions{}},
+		{"8bit content", smtp.MailOptions{Body: smtp.Body8BitMIME}, "bob@example.com", "Subject: hi\r\n\r\nGrüße\r\n",
+			smtp.MailOptions{Body: smtp.Body8BitMIME}},
+		{"utf8 ascii", smtp.MailOptions{UTF8: true}, "bob@example.com", ascii, smtp.MailOptions{}},
+		{"utf8 address", smtp.MailOptions{UTF8: true}, "jörg@example.com", ascii, smtp.MailOptions{UTF8: true}},
+		{"utf8 header", smtp.MailOptions{UTF8: true}, "bob@example.com", "Subject: Grüße\r\n\r\nhi\r\n",
+			smtp.MailOptions{UTF8: true}},
+		{"binary", smtp.MailOptions{Body: smtp.BodyBinaryMIME}, "bob@example.com", ascii,
+			smtp.MailOptions{Body: smtp.BodyBinaryMIME}},
+	}
+
+	for _, tc := range cases {
+		if got := c.Downgrade(&tc.opts, "alice@example.com", []string{tc.to}, tc.body); *got != tc.want {
+			t.Errorf("%s: got %+v, want %+v", tc.name, *got, tc.want)
+		}
+	}
+}
+
+func TestClient_Body7BitOnlyWhereKnown(t *testing.T) {
+	for _, tc := range []struct {
+		exts []string
+		want string
+	}{
+		{nil, "MAIL FROM:<alice@example.com>"},
+		{[]string{"8BITMIME"}, "MAIL FROM:<alice@example.com> BODY=7BIT"},
+	} {
+		addr, cmds := plainServer(t, tc.exts...)
+		c, err := smtp.Dial(addr, smtp.DefaultClientTimeouts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Hello("client.example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Mail("alice@example.com", &smtp.MailOptions{Body: smtp.Body7Bit}); err != nil {
+			t.Errorf("%v: %v", tc.exts, err)
+		}
+		c.Close()
+
+		<-cmds // EHLO
+		if got := <-cmds; got != tc.want {
+			t.Errorf("%v: sent %q, want %q", tc.exts, got, tc.want)
+		}
+	}
+}
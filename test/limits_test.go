@@ -0,0 +1,205 @@
+package main_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"smtp-server/smtp"
+)
+
+// limitedServer returns a server without AUTH whose test can tune the
+// session limits before starting it.
+func limitedServer() *smtp.Server {
+	srv := smtp.NewServer(&memBackend{})
+	srv.AuthRequired = false
+	return srv
+}
+
+// assertClosed checks that the server has closed conn.
+func assertClosed(t *testing.T, conn net.Conn, r *bufio.Reader) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("expected the connection to be closed, got %v", err)
+	}
+}
+
+// ─────────────────────────────────────────────
+// Timeouts
+// ─────────────────────────────────────────────
+
+func TestLimits_GreetingTimeout(t *testing.T) {
+	srv := limitedServer()
+	srv.Timeouts = smtp.Timeouts{Greeting: 200 * time.Millisecond, Command: time.Minute}
+	conn, r, _ := dialServer(t, startServer(t, srv))
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line := readLine(t, r)
+	assertCode(t, line, "421")
+	if !strings.Contains(line, "4.4.2") {
+		t.Errorf("expected 4.4.2, got %q", line)
+	}
+	assertClosed(t, conn, r)
+}
+
+func TestLimits_CommandTimeout(t *testing.T) {
+	srv := limitedServer()
+	srv.Timeouts = smtp.Timeouts{Command: 200 * time.Millisecond}
+	conn, r, w := dialServer(t, startServer(t, srv))
+
+	// Each command gets the full timeout afresh.
+	for range 3 {
+		time.Sleep(100 * time.Millisecond)
+		send(t, w, "NOOP")
+		assertCode(t, readLine(t, r), "250")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	assertCode(t, readLine(t, r), "421")
+	assertClosed(t, conn, r)
+}
+
+func TestLimits_DataTerminationBoundsTrickle(t *testing.T) {
+	srv := limitedServer()
+	srv.Timeouts = smtp.Timeouts{
+		Command:         time.Minute,
+		DataBlock:       200 * time.Millisecond,
+		DataTermination: 500 * time.Millisecond,
+	}
+	conn, r, w := dialServer(t, startServer(t, srv))
+
+	send(t, w, "HELO client.example.com")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "MAIL FROM:<alice@example.com>")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "RCPT TO:<bob@example.com>")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "DATA")
+	assertCode(t, readLine(t, r), "354")
+
+	// Every line arrives well within DataBlock, but the message as a
+	// whole never ends.
+	stop := time.After(2 * time.Second)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(50 * time.Millisecond):
+				if _, err := conn.Write([]byte("x\r\n")); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	line := readLine(t, r)
+	assertCode(t, line, "421")
+}
+
+// ─────────────────────────────────────────────
+// Line length and errors
+// ─────────────────────────────────────────────
+
+func TestLimits_LongLineRejected(t *testing.T) {
+	srv := limitedServer()
+	srv.MaxLineLength = 512
+	_, r, w := dialServer(t, startServer(t, srv))
+
+	send(t, w, "HELO "+strings.Repeat("x", 10000))
+	assertCode(t, readLine(t, r), "500")
+
+	// The rest of the long line was consumed, the session goes on.
+	send(t, w, "HELO client.example.com")
+	assertCode(t, readLine(t, r), "250")
+}
+
+func TestLimits_MessageLimitsChangedWhileRunning(t *testing.T) {
+	srv := limitedServer()
+	_, r, w := dialServer(t, startServer(t, srv))
+
+	srv.SetMessageLimits(1, 1000)
+	send(t, w, "EHLO client.example.com")
+	if exts := strings.Join(readReply(t, r), "\n"); !strings.Contains(exts, "SIZE 1000") {
+		t.Errorf("new size not advertised: %q", exts)
+	}
+	send(t, w, "MAIL FROM:<alice@example.com> SIZE=2000")
+	assertCode(t, readLine(t, r), "552")
+	send(t, w, "MAIL FROM:<alice@example.com>")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "RCPT TO:<bob@example.com>")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "RCPT TO:<carol@example.com>")
+	assertCode(t, readLine(t, r), "452")
+}
+
+func TestLimits_TooManyErrorsDisconnects(t *testing.T) {
+	srv := limitedServer()
+	srv.MaxErrors = 3
+	conn, r, w := dialServer(t, startServer(t, srv))
+
+	send(t, w, "BOGUS")
+	assertCode(t, readLine(t, r), "500")
+	send(t, w, "HELO")
+	assertCode(t, readLine(t, r), "501")
+	send(t, w, "NOOP")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "BOGUS")
+	assertCode(t, readLine(t, r), "500")
+	assertCode(t, readLine(t, r), "421")
+	assertClosed(t, conn, r)
+}
+
+// ─────────────────────────────────────────────
+// Connection caps
+// ─────────────────────────────────────────────
+
+func TestLimits_ConnectionsPerIP(t *testing.T) {
+	srv := limitedServer()
+	srv.MaxConnsPerIP = 2
+	addr := startServer(t, srv)
+
+	first, r1, w1 := dialServer(t, addr)
+	dialServer(t, addr)
+
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line := readLine(t, r)
+	assertCode(t, line, "421")
+	if !strings.Contains(line, "4.7.0") {
+		t.Errorf("expected 4.7.0, got %q", line)
+	}
+	assertClosed(t, conn, r)
+
+	// A slot frees up once a session ends.
+	send(t, w1, "QUIT")
+	assertCode(t, readLine(t, r1), "221")
+	assertClosed(t, first, r1)
+	time.Sleep(50 * time.Millisecond)
+	dialServer(t, addr)
+}
+
+func TestLimits_TotalConnections(t *testing.T) {
+	srv := limitedServer()
+	srv.MaxConns = 1
+	addr := startServer(t, srv)
+	dialServer(t, addr)
+
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	assertCode(t, readLine(t, bufio.NewReader(conn)), "421")
+}
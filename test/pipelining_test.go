@@ -0,0 +1,116 @@
+package main_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ─────────────────────────────────────────────
+// PIPELINING
+// ─────────────────────────────────────────────
+
+func TestPipelining_Advertised(t *testing.T) {
+	srv := limitedServer()
+	_, r, w := dialServer(t, startServer(t, srv))
+
+	send(t, w, "EHLO client.example.com")
+	if exts := strings.Join(readReply(t, r), "\n"); !strings.Contains(exts, "PIPELINING") {
+		t.Errorf("PIPELINING not advertised: %q", exts)
+	}
+}
+
+func TestPipelining_GroupAnsweredInOrder(t *testing.T) {
+	be := &memBackend{}
+	srv := limitedServer()
+	srv.Backend = be
+	conn, r, w := dialServer(t, startServer(t, srv))
+
+	send(t, w, "EHLO client.example.com")
+	readReply(t, r)
+
+	// The whole group goes out in one write, as a pipelining client does.
+	group := "MAIL FROM:<alice@example.com>\r\n" +
+		"RCPT TO:<bob@example.com>\r\n" +
+		"RCPT TO:<carol@example.com>\r\n" +
+		"DATA\r\n"
+	if _, err := conn.Write([]byte(group)); err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range []string{"250", "250", "250", "354"} {
+		assertCode(t, readLine(t, r), code)
+	}
+
+	if _, err := conn.Write([]byte("Subject: hi\r\n\r\nhello\r\n.\r\nNOOP\r\nQUIT\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range []string{"250", "250", "221"} {
+		assertCode(t, readLine(t, r), code)
+	}
+
+	msgs := be.Messages()
+	if len(msgs) != 1 || len(msgs[0].To) != 2 || msgs[0].Data != "Subject: hi\r\n\r\nhello\r\n" {
+		t.Errorf("unexpected messages: %+v", msgs)
+	}
+}
+
+func TestPipelining_CommandsAfterStartTLSDropped(t *testing.T) {
+	srv := tlsServer(t)
+	conn, r, w := dialServer(t, startServer(t, srv))
+
+	send(t, w, "EHLO client.example.com")
+	readReply(t, r)
+	// NOOP is smuggled in plaintext behind STARTTLS and must not be
+	// answered once TLS is up.
+	if _, err := conn.Write([]byte("STARTTLS\r\nNOOP\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	assertCode(t, readLine(t, r), "220")
+
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	r, w = bufio.NewReader(tlsConn), bufio.NewWriter(tlsConn)
+	send(t, w, "QUIT")
+	assertCode(t, readLine(t, r), "221")
+}
+
+// ─────────────────────────────────────────────
+// Early talkers
+// ─────────────────────────────────────────────
+
+func TestPipelining_EarlyTalkerRejected(t *testing.T) {
+	srv := limitedServer()
+	srv.GreetingDelay = 300 * time.Millisecond
+	addr := startServer(t, srv)
+
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	send(t, bufio.NewWriter(conn), "EHLO spammer.example.com")
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	assertCode(t, readLine(t, r), "554")
+	assertClosed(t, conn, r)
+}
+
+func TestPipelining_PatientClientGreeted(t *testing.T) {
+	srv := limitedServer()
+	srv.GreetingDelay = 300 * time.Millisecond
+	addr := startServer(t, srv)
+
+	start := time.Now()
+	_, r, w := dialServer(t, addr)
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("greeting sent after %v, before the delay", elapsed)
+	}
+	send(t, w, "NOOP")
+	assertCode(t, readLine(t, r), "250")
+}
@@ -0,0 +1,184 @@
+package main_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"smtp-server/resolver"
+)
+
+// ─────────────────────────────────────────────
+// MX selection
+// ─────────────────────────────────────────────
+
+func TestMXHosts_OrderedByPreference(t *testing.T) {
+	r := &resolver.Static{MX: map[string][]*net.MX{
+		"example.com": {
+			{Host: "backup.example.com.", Pref: 20},
+			{Host: "mx1.example.com.", Pref: 10},
+		},
+	}}
+
+	hosts, err := resolver.MXHosts(context.Background(), r, "Example.COM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 2 || hosts[0] != "mx1.example.com" || hosts[1] != "backup.example.com" {
+		t.Errorf("unexpected order %v", hosts)
+	}
+}
+
+func TestMXHosts_LeavesRecordsAlone(t *testing.T) {
+	records := []*net.MX{
+		{Host: "mx3.example.com.", Pref: 30},
+		{Host: "mx1.example.com.", Pref: 10},
+		{Host: "mx2a.example.com.", Pref: 20},
+		{Host: "mx2b.example.com.", Pref: 20},
+	}
+	r := &resolver.Static{MX: map[string][]*net.MX{"example.com": slices.Clone(records)}}
+
+	for range 20 {
+		if _, err := resolver.MXHosts(context.Background(), r, "example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !slices.Equal(r.MX["example.com"], records) {
+		t.Errorf("resolver records reordered: %v", r.MX["example.com"])
+	}
+}
+
+func TestMXHosts_ImplicitNullAndMissing(t *testing.T) {
+	r := &resolver.Static{
+		MX: map[string][]*net.MX{"nomail.example": {{Host: ".", Pref: 0}}},
+		IP: map[string][]net.IPAddr{"bare.example": {{IP: net.IPv4(192, 0, 2, 1)}}},
+	}
+	ctx := context.Background()
+
+	if hosts, err := resolver.MXHosts(ctx, r, "bare.example"); err != nil || len(hosts) != 1 || hosts[0] != "bare.example" {
+		t.Errorf("implicit MX: got %v %v", hosts, err)
+	}
+	if _, err := resolver.MXHosts(ctx, r, "nomail.example"); !errors.Is(err, resolver.ErrNullMX) {
+		t.Errorf("null MX: got %v", err)
+	}
+	if _, err := resolver.MXHosts(ctx, r, "missing.example"); !errors.Is(err, resolver.ErrNoSuchDomain) {
+		t.Errorf("missing domain: got %v", err)
+	}
+}
+
+// ─────────────────────────────────────────────
+// Caching client
+// ─────────────────────────────────────────────
+
+// dnsServer answers MX queries for example.com and NXDOMAIN for anything
+// else, counting the queries that reach it.
+func dnsServer(t *testing.T) (string, *atomic.Int32) {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var queries atomic.Int32
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		queries.Add(1)
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+
+		q := req.Question[0]
+		if q.Name == "example.com." && q.Qtype == dns.TypeMX {
+			rr, _ := dns.NewRR("example.com. 300 IN MX 10 mx.example.com.")
+			resp.Answer = append(resp.Answer, rr)
+		} else {
+			resp.Rcode = dns.RcodeNameError
+			soa, _ := dns.NewRR("example.com. 300 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 60")
+			resp.Ns = append(resp.Ns, soa)
+		}
+		w.WriteMsg(resp)
+	})
+
+	srv := &dns.Server{PacketConn: pc, Handler: handler}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+
+	return pc.LocalAddr().String(), &queries
+}
+
+func TestResolverClient_CachesAnswers(t *testing.T) {
+	addr, queries := dnsServer(t)
+	c := resolver.NewClient([]string{addr})
+	ctx := context.Background()
+
+	for range 3 {
+		mx, err := c.LookupMX(ctx, "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(mx) != 1 || mx[0].Host != "mx.example.com." || mx[0].Pref != 10 {
+			t.Fatalf("unexpected answer %v", mx)
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("expected 1 upstream query, got %d", n)
+	}
+}
+
+func TestResolverClient_CachesNegativeAnswers(t *testing.T) {
+	addr, queries := dnsServer(t)
+	c := resolver.NewClient([]string{addr})
+	ctx := context.Background()
+
+	for range 2 {
+		_, err := c.LookupMX(ctx, "missing.example.com")
+		if !resolver.IsNotFound(err) {
+			t.Fatalf("expected not found, got %v", err)
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("expected 1 upstream query, got %d", n)
+	}
+}
+
+func TestResolverClient_CacheIsCapped(t *testing.T) {
+	addr, queries := dnsServer(t)
+	c := resolver.NewClient([]string{addr})
+	c.MaxEntries = 2
+	ctx := context.Background()
+
+	names := []string{"a.example.com", "b.example.com", "c.example.com"}
+	for range 2 {
+		for _, name := range names {
+			if _, err := c.LookupMX(ctx, name); !resolver.IsNotFound(err) {
+				t.Fatalf("%s: expected not found, got %v", name, err)
+			}
+		}
+	}
+	// Three names do not fit in two entries, so some had to be asked for
+	// again.
+	if n := queries.Load(); n <= 3 {
+		t.Errorf("expected more than 3 upstream queries, got %d", n)
+	}
+}
+
+func TestResolverClient_UnreachableServerIsTemporary(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+
+	c := resolver.NewClient([]string{addr})
+	_, err = c.LookupMX(context.Background(), "example.com")
+
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsTemporary || dnsErr.IsNotFound {
+		t.Errorf("expected temporary DNS error, got %v", err)
+	}
+}
@@ -0,0 +1,189 @@
+package main_test
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"smtp-server/smtp"
+)
+
+var (
+	memSCRAMOnce  sync.Once
+	memSCRAMCreds *smtp.SCRAMCredentials
+)
+
+// SCRAMCredentials knows only alice, whose password is "secret".
+func (s *memSession) SCRAMCredentials(username string) (*smtp.SCRAMCredentials, error) {
+	if username != "alice" {
+		return nil, smtp.ErrAuthFailed
+	}
+	memSCRAMOnce.Do(func() {
+		memSCRAMCreds, _ = smtp.NewSCRAMCredentials("secret")
+	})
+	return memSCRAMCreds, nil
+}
+
+func (s *memSession) SCRAMResult(username string, ok bool) error {
+	return nil
+}
+
+// ─────────────────────────────────────────────
+// SASL mechanisms
+// ─────────────────────────────────────────────
+
+func TestSASL_PlainInitialResponse(t *testing.T) {
+	addr := startServer(t, smtp.NewServer(&memBackend{}))
+	_, r, w := dialServer(t, addr)
+
+	send(t, w, "AUTH PLAIN "+b64("\x00alice\x00secret"))
+	assertCode(t, readLine(t, r), "235")
+}
+
+func TestSASL_PlainChallenge(t *testing.T) {
+	addr := startServer(t, smtp.NewServer(&memBackend{}))
+	_, r, w := dialServer(t, addr)
+
+	send(t, w, "AUTH PLAIN")
+	assertCode(t, readLine(t, r), "334")
+	send(t, w, b64("\x00alice\x00wrong"))
+	assertCode(t, readLine(t, r), "535")
+}
+
+func TestSASL_LoginInitialResponseHitsLimiter(t *testing.T) {
+	addr := startServer(t, smtp.NewServer(&memBackend{}))
+	_, r, w := dialServer(t, addr)
+
+	send(t, w, "AUTH LOGIN "+b64("locked"))
+	assertCode(t, readLine(t, r), "454")
+}
+
+func TestSASL_UnknownMechanism(t *testing.T) {
+	addr := startServer(t, smtp.NewServer(&memBackend{}))
+	_, r, w := dialServer(t, addr)
+
+	send(t, w, "AUTH SCRAM-SHA-256")
+	assertCode(t, readLine(t, r), "504")
+}
+
+func TestSASL_SCRAMSHA256(t *testing.T) {
+	for _, password := range []string{"secret", "wrong"} {
+		t.Run(password, func(t *testing.T) {
+			srv := smtp.NewServer(&memBackend{})
+			srv.EnableAuth("SCRAM-SHA-256", smtp.SCRAMSHA256Mechanism)
+			addr := startServer(t, srv)
+			_, r, w := dialServer(t, addr)
+
+			got := scramLogin(t, r, w, "alice", password, "biws")
+			if password == "secret" {
+				assertCode(t, got, "235")
+			} else {
+				assertCode(t, got, "535")
+			}
+		})
+	}
+}
+
+func TestSASL_SCRAMUnknownUserLooksKnown(t *testing.T) {
+	srv := smtp.NewServer(&memBackend{})
+	srv.EnableAuth("SCRAM-SHA-256", smtp.SCRAMSHA256Mechanism)
+	addr := startServer(t, srv)
+
+	// serverFirst returns the salt and iteration count offered to user.
+	serverFirst := func(user string) (string, string) {
+		_, r, w := dialServer(t, addr)
+		send(t, w, "AUTH SCRAM-SHA-256 "+b64("n,,n="+user+",r=clientnonce"))
+		resp := readLine(t, r)
+		assertCode(t, resp, "334")
+		msg, _ := base64.StdEncoding.DecodeString(resp[4:])
+		attrs := map[string]string{}
+		for _, f := range strings.Split(string(msg), ",") {
+			attrs[f[:1]] = f[2:]
+		}
+		return attrs["s"], attrs["i"]
+	}
+
+	aliceSalt, aliceIter := serverFirst("alice")
+	nobodySalt, nobodyIter := serverFirst("nobody")
+	if len(nobodySalt) != len(aliceSalt) || nobodyIter != aliceIter {
+		t.Errorf("challenges differ in shape: alice s=%s i=%s, nobody s=%s i=%s", aliceSalt, aliceIter, nobodySalt, nobodyIter)
+	}
+	if again, _ := serverFirst("nobody"); again != nobodySalt {
+		t.Errorf("salt for an unknown user changed: %s, then %s", nobodySalt, again)
+	}
+	if other, _ := serverFirst("somebody"); other == nobodySalt {
+		t.Error("two unknown users got the same salt")
+	}
+
+	// The exchange fails only at client-final.
+	_, r, w := dialServer(t, addr)
+	assertCode(t, scramLogin(t, r, w, "nobody", "secret", "biws"), "535")
+}
+
+func TestSASL_SCRAMChannelBindingMustMatch(t *testing.T) {
+	// The client-first-message says "n,,", which is "biws" in base64.
+	for _, cbind := range []string{"eSws", "cD10bHMtdW5pcXVlLCw=", ""} {
+		srv := smtp.NewServer(&memBackend{})
+		srv.EnableAuth("SCRAM-SHA-256", smtp.SCRAMSHA256Mechanism)
+		_, r, w := dialServer(t, startServer(t, srv))
+
+		if got := scramLogin(t, r, w, "alice", "secret", cbind); !strings.HasPrefix(got, "535") {
+			t.Errorf("c=%s: got %q, want 535", cbind, got)
+		}
+	}
+}
+
+// scramLogin runs the client side of SCRAM-SHA-256 sending cbind as the
+// c= attribute, checks the server signature, and returns the final reply.
+func scramLogin(t *testing.T, r *bufio.Reader, w *bufio.Writer, user, password, cbind string) string {
+	t.Helper()
+	clientFirstBare := "n=" + user + ",r=clientnonce"
+	send(t, w, "AUTH SCRAM-SHA-256 "+b64("n,,"+clientFirstBare))
+
+	resp := readLine(t, r)
+	assertCode(t, resp, "334")
+	serverFirstBytes, _ := base64.StdEncoding.DecodeString(resp[4:])
+	serverFirst := string(serverFirstBytes)
+
+	attrs := map[string]string{}
+	for _, f := range strings.Split(serverFirst, ",") {
+		attrs[f[:1]] = f[2:]
+	}
+	salt, _ := base64.StdEncoding.DecodeString(attrs["s"])
+	iter, _ := strconv.Atoi(attrs["i"])
+
+	salted, _ := pbkdf2.Key(sha256.New, password, salt, iter, sha256.Size)
+	clientKey := hmacSum(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	finalWithoutProof := "c=" + cbind + ",r=" + attrs["r"]
+	authMessage := clientFirstBare + "," + serverFirst + "," + finalWithoutProof
+	signature := hmacSum(storedKey[:], authMessage)
+	for i := range clientKey {
+		clientKey[i] ^= signature[i]
+	}
+	send(t, w, b64(finalWithoutProof+",p="+base64.StdEncoding.EncodeToString(clientKey)))
+
+	resp = readLine(t, r)
+	if !strings.HasPrefix(resp, "334") {
+		return resp
+	}
+	serverFinal, _ := base64.StdEncoding.DecodeString(resp[4:])
+	want := "v=" + base64.StdEncoding.EncodeToString(hmacSum(hmacSum(salted, "Server Key"), authMessage))
+	if string(serverFinal) != want {
+		t.Errorf("bad server signature %q, want %q", serverFinal, want)
+	}
+	send(t, w, "")
+	return readLine(t, r)
+}
+
+func hmacSum(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
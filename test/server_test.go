@@ -0,0 +1,299 @@
+package main_test
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"smtp-server/smtp"
+)
+
+// ─────────────────────────────────────────────
+// In-memory backend
+// ─────────────────────────────────────────────
+
+// memMessage is one transaction accepted by memBackend.
+type memMessage struct {
+	From     string
+	To       []string
+	Data     string
+	MailOpts *smtp.MailOptions
+	RcptOpts []*smtp.RcptOptions
+}
+
+// memBackend accepts any user whose password is "secret" and keeps every
+// message in memory, so the protocol engine can be tested without Redis.
+type memBackend struct {
+	mu       sync.Mutex
+	messages []memMessage
+}
+
+func (b *memBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &memSession{backend: b}, nil
+}
+
+func (b *memBackend) Messages() []memMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]memMessage(nil), b.messages...)
+}
+
+type memSession struct {
+	backend *memBackend
+	msg     memMessage
+}
+
+func (s *memSession) AuthAllowed(username string) error {
+	if username == "locked" {
+		return &smtp.SMTPError{Code: 454, Message: "Too many login attempts"}
+	}
+	return nil
+}
+
+func (s *memSession) Auth(username, password string) error {
+	if password != "secret" {
+		return smtp.ErrAuthFailed
+	}
+	return nil
+}
+
+func (s *memSession) Mail(from string, opts *smtp.MailOptions) error {
+	if strings.HasSuffix(from, "@evil.com") {
+		return errors.New("sender rejected")
+	}
+	s.msg = memMessage{From: from, MailOpts: opts}
+	return nil
+}
+
+func (s *memSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	s.msg.To = append(s.msg.To, to)
+	s.msg.RcptOpts = append(s.msg.RcptOpts, opts)
+	return nil
+}
+
+func (s *memSession) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.msg.Data = string(data)
+
+	s.backend.mu.Lock()
+	s.backend.messages = append(s.backend.messages, s.msg)
+	s.backend.mu.Unlock()
+	return nil
+}
+
+func (s *memSession) Reset() {
+	s.msg = memMessage{}
+}
+
+func (s *memSession) Logout() error {
+	return nil
+}
+
+// startServer runs srv on a random loopback port and returns its address.
+func startServer(t *testing.T, srv *smtp.Server) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().String()
+}
+
+// dialServer connects to addr and consumes the 220 greeting.
+func dialServer(t *testing.T, addr string) (net.Conn, *bufio.Reader, *bufio.Writer) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	assertCode(t, readLine(t, r), "220")
+	return conn, r, w
+}
+
+// ─────────────────────────────────────────────
+// Protocol engine
+// ─────────────────────────────────────────────
+
+func TestServer_RequiresAuth(t *testing.T) {
+	addr := startServer(t, smtp.NewServer(&memBackend{}))
+	_, r, w := dialServer(t, addr)
+
+	send(t, w, "MAIL FROM:<a@example.com>")
+	assertCode(t, readLine(t, r), "530")
+}
+
+func TestServer_AuthLogin(t *testing.T) {
+	cases := []struct {
+		user, pass, want string
+	}{
+		{"alice", "secret", "235"},
+		{"alice", "wrong", "535"},
+	}
+	addr := startServer(t, smtp.NewServer(&memBackend{}))
+
+	for _, tc := range cases {
+		t.Run(tc.user+"/"+tc.pass, func(t *testing.T) {
+			_, r, w := dialServer(t, addr)
+			send(t, w, "AUTH LOGIN")
+			assertCode(t, readLine(t, r), "334")
+			send(t, w, b64(tc.user))
+			assertCode(t, readLine(t, r), "334")
+			send(t, w, b64(tc.pass))
+			assertCode(t, readLine(t, r), tc.want)
+		})
+	}
+}
+
+func TestServer_AuthLimiterRunsBeforePassword(t *testing.T) {
+	addr := startServer(t, smtp.NewServer(&memBackend{}))
+	_, r, w := dialServer(t, addr)
+
+	send(t, w, "AUTH LOGIN")
+	assertCode(t, readLine(t, r), "334")
+	send(t, w, b64("locked"))
+	assertCode(t, readLine(t, r), "454")
+}
+
+func TestServer_BackendErrorBecomesLocalError(t *testing.T) {
+	addr := startServer(t, smtp.NewServer(&memBackend{}))
+	_, r, w := dialServer(t, addr)
+	memLogin(t, r, w)
+
+	send(t, w, "MAIL FROM:<bob@evil.com>")
+	assertCode(t, readLine(t, r), "451")
+}
+
+func TestServer_DeliversToBackend(t *testing.T) {
+	be := &memBackend{}
+	addr := startServer(t, smtp.NewServer(be))
+	_, r, w := dialServer(t, addr)
+	memLogin(t, r, w)
+
+	send(t, w, "MAIL FROM:<alice@example.com>")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "RCPT TO:<bob@example.org>")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "DATA")
+	assertCode(t, readLine(t, r), "354")
+	send(t, w, "Subject: hi")
+	send(t, w, ".")
+	assertCode(t, readLine(t, r), "250")
+
+	msgs := be.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+	if msgs[0].From != "alice@example.com" || fmt.Sprint(msgs[0].To) != "[bob@example.org]" {
+		t.Errorf("unexpected envelope: %+v", msgs[0])
+	}
+}
+
+func TestServer_MultipleRecipients(t *testing.T) {
+	be := &memBackend{}
+	srv := smtp.NewServer(be)
+	srv.MaxRecipients = 2
+	addr := startServer(t, srv)
+	_, r, w := dialServer(t, addr)
+	memLogin(t, r, w)
+
+	send(t, w, "MAIL FROM:<alice@example.com>")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "RCPT TO:<bob@example.org>")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "RCPT TO:<carol@myserver.local>")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "RCPT TO:<dave@example.net>")
+	assertCode(t, readLine(t, r), "452")
+	send(t, w, "DATA")
+	assertCode(t, readLine(t, r), "354")
+	send(t, w, ".")
+	assertCode(t, readLine(t, r), "250")
+
+	msgs := be.Messages()
+	if len(msgs) != 1 || fmt.Sprint(msgs[0].To) != "[bob@example.org carol@myserver.local]" {
+		t.Errorf("unexpected messages: %+v", msgs)
+	}
+}
+
+func TestServer_InboundWithoutAuth(t *testing.T) {
+	be := &memBackend{}
+	srv := smtp.NewServer(be)
+	srv.AuthRequired = false
+	addr := startServer(t, srv)
+	_, r, w := dialServer(t, addr)
+
+	send(t, w, "EHLO mta.example.org")
+	readReply(t, r)
+	send(t, w, "MAIL FROM:<>")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "RCPT TO:<carol@myserver.local>")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "DATA")
+	assertCode(t, readLine(t, r), "354")
+	send(t, w, ".")
+	assertCode(t, readLine(t, r), "250")
+
+	if msgs := be.Messages(); len(msgs) != 1 || msgs[0].From != "" {
+		t.Errorf("unexpected messages: %+v", msgs)
+	}
+}
+
+func TestServer_EhloAdvertisesExtensions(t *testing.T) {
+	addr := startServer(t, smtp.NewServer(&memBackend{}))
+	_, r, w := dialServer(t, addr)
+
+	send(t, w, "EHLO client.example.com")
+	lines := readReply(t, r)
+	assertCode(t, lines[0], "250")
+	exts := strings.Join(lines[1:], "\n")
+	for _, want := range []string{"ENHANCEDSTATUSCODES", "AUTH LOGIN"} {
+		if !strings.Contains(exts, want) {
+			t.Errorf("EHLO reply missing %s: %q", want, lines)
+		}
+	}
+
+	memLogin(t, r, w)
+	send(t, w, "EHLO client.example.com")
+	if exts := strings.Join(readReply(t, r), "\n"); strings.Contains(exts, "AUTH") {
+		t.Errorf("AUTH advertised after authentication: %q", exts)
+	}
+}
+
+// readReply reads every line of a possibly multi-line reply.
+func readReply(t *testing.T, r *bufio.Reader) []string {
+	t.Helper()
+	var lines []string
+	for {
+		line := readLine(t, r)
+		lines = append(lines, line)
+		if len(line) < 4 || line[3] != '-' {
+			return lines
+		}
+	}
+}
+
+// memLogin authenticates as alice and sends HELO.
+func memLogin(t *testing.T, r *bufio.Reader, w *bufio.Writer) {
+	t.Helper()
+	send(t, w, "AUTH LOGIN")
+	assertCode(t, readLine(t, r), "334")
+	send(t, w, b64("alice"))
+	assertCode(t, readLine(t, r), "334")
+	send(t, w, b64("secret"))
+	assertCode(t, readLine(t, r), "235")
+	send(t, w, "HELO localhost")
+	assertCode(t, readLine(t, r), "250")
+}
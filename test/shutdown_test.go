@@ -0,0 +1,76 @@
+package main_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"smtp-server/smtp"
+)
+
+// ─────────────────────────────────────────────
+// Graceful shutdown
+// ─────────────────────────────────────────────
+
+func TestShutdown_LetsSessionsFinishThenSends421(t *testing.T) {
+	be := &memBackend{}
+	srv := smtp.NewServer(be)
+	srv.AuthRequired = false
+	addr := startServer(t, srv)
+	conn, r, w := dialServer(t, addr)
+
+	send(t, w, "EHLO client.example.com")
+	readReply(t, r)
+	send(t, w, "MAIL FROM:<alice@example.com>")
+	assertCode(t, readLine(t, r), "250")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- srv.Shutdown(ctx) }()
+
+	// New connections are refused straight away...
+	time.Sleep(50 * time.Millisecond)
+	if c, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		c.Close()
+		t.Error("server still accepting after Shutdown")
+	}
+
+	// ...while the open session keeps working during the grace period.
+	send(t, w, "RCPT TO:<bob@example.org>")
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "DATA")
+	assertCode(t, readLine(t, r), "354")
+	conn.Write([]byte("Subject: x\r\n\r\n.\r\n"))
+	assertCode(t, readLine(t, r), "250")
+
+	// Once it is over, the idle session is told to go away.
+	assertCode(t, readLine(t, r), "421")
+	if err := <-done; err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if len(be.Messages()) != 1 {
+		t.Error("message accepted during the grace period was lost")
+	}
+}
+
+func TestShutdown_ReturnsOnceSessionsQuit(t *testing.T) {
+	srv := smtp.NewServer(&memBackend{})
+	addr := startServer(t, srv)
+	_, r, w := dialServer(t, addr)
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Shutdown(context.Background()) }()
+
+	send(t, w, "QUIT")
+	assertCode(t, readLine(t, r), "221")
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown did not return after the last session quit")
+	}
+}
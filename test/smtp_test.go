@@ -30,6 +30,13 @@ const (
 
 	testUsername2 = "testuser2"
 	testEmail2    = "testuser2@example.com"
+
+	// Users on the server's default local domain, whose mail is
+	// delivered to their mailboxes instead of relayed.
+	localUsername  = "localsender"
+	localEmail     = "localsender@myserver.local"
+	localUsername2 = "localrcpt"
+	localEmail2    = "localrcpt@myserver.local"
 )
 
 // ─────────────────────────────────────────────
@@ -46,6 +53,9 @@ func redisClient() *redis.Client {
 // The IP bucket is always 127.0.0.1 because tests connect locally.
 func cleanAll(t *testing.T, rdb *redis.Client, username string) {
 	t.Helper()
+	if email, err := rdb.HGet(context.Background(), "user:"+username, "email").Result(); err == nil {
+		rdb.Del(context.Background(), "address:"+strings.ToLower(email))
+	}
 	rdb.Del(context.Background(),
 		"user:"+username,
 		"auth:fail:user:"+username,
@@ -56,6 +66,24 @@ func cleanAll(t *testing.T, rdb *redis.Client, username string) {
 	)
 }
 
+// mailboxKeys lists the messages in a user's mailbox.
+func mailboxKeys(t *testing.T, rdb *redis.Client, username string) []string {
+	t.Helper()
+	keys, err := rdb.Keys(context.Background(), "mailbox:"+username+":*").Result()
+	if err != nil {
+		t.Fatalf("listing mailbox of %s: %v", username, err)
+	}
+	return keys
+}
+
+// cleanMailbox empties a user's mailbox.
+func cleanMailbox(t *testing.T, rdb *redis.Client, username string) {
+	t.Helper()
+	if keys := mailboxKeys(t, rdb, username); len(keys) > 0 {
+		rdb.Del(context.Background(), keys...)
+	}
+}
+
 // createUser calls the HTTP endpoint and returns the status code.
 func createUser(t *testing.T, username, password, email string) int {
 	t.Helper()
@@ -254,9 +282,10 @@ func TestAuth_NonExistentUser(t *testing.T) {
 	assertCode(t, smtpLogin(t, r, w, "ghost_user_xyz", "anypassword"), "535")
 }
 
+// HELO/EHLO are deliberately absent: the client needs the EHLO reply to
+// discover the AUTH mechanisms, so greeting is allowed before login.
 func TestAuth_CommandsRequireAuth(t *testing.T) {
 	cmds := []string{
-		"HELO localhost",
 		"MAIL FROM:<a@b.com>",
 		"RCPT TO:<c@d.com>",
 		"DATA",
@@ -560,3 +589,68 @@ func TestSMTP_UnknownCommand(t *testing.T) {
 		t.Errorf("expected 500 (or 250 if not yet fixed) for unknown command, got: %q", resp)
 	}
 }
+
+// ─────────────────────────────────────────────
+// Local delivery
+// ─────────────────────────────────────────────
+
+func TestSMTP_LocalDeliveryReachesRecipient(t *testing.T) {
+	rdb := redisClient()
+	for _, u := range []string{localUsername, localUsername2} {
+		cleanAll(t, rdb, u)
+		cleanMailbox(t, rdb, u)
+		defer cleanAll(t, rdb, u)
+		defer cleanMailbox(t, rdb, u)
+	}
+	createUser(t, localUsername, testPassword, localEmail)
+	createUser(t, localUsername2, testPassword, localEmail2)
+
+	conn, r, w := fullLogin(t, localUsername, testPassword)
+	defer conn.Close()
+
+	send(t, w, fmt.Sprintf("MAIL FROM:<%s>", localEmail))
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, fmt.Sprintf("RCPT TO:<%s>", localEmail2))
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "DATA")
+	assertCode(t, readLine(t, r), "354")
+	send(t, w, "Subject: Local\r\n\r\nfor the recipient")
+	send(t, w, ".")
+	assertCode(t, readLine(t, r), "250")
+
+	// Delivery happens in the background.
+	var keys []string
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if keys = mailboxKeys(t, rdb, localUsername2); len(keys) > 0 {
+			break
+		}
+	}
+	if len(keys) != 1 {
+		t.Fatalf("expected one message in %s's mailbox, got %q", localUsername2, keys)
+	}
+	stored, err := rdb.HGetAll(context.Background(), keys[0]).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored["to"] != localEmail2 || stored["from"] != localEmail || !strings.Contains(stored["data"], "for the recipient") {
+		t.Errorf("unexpected mailbox entry: %q", stored)
+	}
+	if keys := mailboxKeys(t, rdb, localUsername); len(keys) != 0 {
+		t.Errorf("message landed in the sender's mailbox: %q", keys)
+	}
+}
+
+func TestSMTP_UnknownLocalRecipient(t *testing.T) {
+	rdb := redisClient()
+	cleanAll(t, rdb, localUsername)
+	defer cleanAll(t, rdb, localUsername)
+	createUser(t, localUsername, testPassword, localEmail)
+
+	conn, r, w := fullLogin(t, localUsername, testPassword)
+	defer conn.Close()
+
+	send(t, w, fmt.Sprintf("MAIL FROM:<%s>", localEmail))
+	assertCode(t, readLine(t, r), "250")
+	send(t, w, "RCPT TO:<nobody-here@myserver.local>")
+	assertCode(t, readLine(t, r), "550")
+}
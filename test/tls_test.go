@@ -0,0 +1,193 @@
+package main_test
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"smtp-server/smtp"
+)
+
+// writeCert writes a fresh self-signed certificate for commonName into dir
+// and returns the certificate and key paths.
+func writeCert(t *testing.T, dir, commonName string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+// tlsServer returns a server with STARTTLS enabled from a temporary cert.
+func tlsServer(t *testing.T) *smtp.Server {
+	t.Helper()
+	certs, err := smtp.NewCertReloader(writeCert(t, t.TempDir(), "mx.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := smtp.NewServer(&memBackend{})
+	srv.TLSConfig = certs.TLSConfig()
+	srv.AuthRequiresTLS = true
+	return srv
+}
+
+// ─────────────────────────────────────────────
+// STARTTLS
+// ─────────────────────────────────────────────
+
+func TestTLS_AuthRefusedBeforeStartTLS(t *testing.T) {
+	addr := startServer(t, tlsServer(t))
+	_, r, w := dialServer(t, addr)
+
+	send(t, w, "EHLO client.example.com")
+	exts := strings.Join(readReply(t, r), "\n")
+	if !strings.Contains(exts, "STARTTLS") || strings.Contains(exts, "AUTH") {
+		t.Errorf("expected STARTTLS without AUTH before TLS, got %q", exts)
+	}
+
+	send(t, w, "AUTH LOGIN")
+	assertCode(t, readLine(t, r), "538")
+}
+
+func TestTLS_StartTLSResetsSession(t *testing.T) {
+	addr := startServer(t, tlsServer(t))
+	conn, r, w := dialServer(t, addr)
+
+	send(t, w, "EHLO client.example.com")
+	readReply(t, r)
+	send(t, w, "STARTTLS")
+	assertCode(t, readLine(t, r), "220")
+
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	r, w = bufio.NewReader(tlsConn), bufio.NewWriter(tlsConn)
+
+	// The pre-TLS EHLO must be forgotten.
+	send(t, w, "AUTH LOGIN")
+	assertCode(t, readLine(t, r), "334")
+	send(t, w, b64("alice"))
+	assertCode(t, readLine(t, r), "334")
+	send(t, w, b64("secret"))
+	assertCode(t, readLine(t, r), "235")
+	send(t, w, "MAIL FROM:<alice@example.com>")
+	assertCode(t, readLine(t, r), "503")
+
+	send(t, w, "EHLO client.example.com")
+	if exts := strings.Join(readReply(t, r), "\n"); strings.Contains(exts, "STARTTLS") {
+		t.Errorf("STARTTLS advertised on an encrypted connection: %q", exts)
+	}
+}
+
+func TestTLS_CertReloaderPicksUpNewFiles(t *testing.T) {
+	dir := t.TempDir()
+	certs, err := smtp.NewCertReloader(writeCert(t, dir, "old.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Make sure the rewritten files get a later modification time.
+	certFile, keyFile := writeCert(t, dir, "new.example.com")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+
+	cert, err := certs.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Subject.CommonName != "new.example.com" {
+		t.Errorf("expected reloaded certificate, got %s", leaf.Subject.CommonName)
+	}
+}
+
+func TestTLS_CertReloaderSetFiles(t *testing.T) {
+	certs, err := smtp.NewCertReloader(writeCert(t, t.TempDir(), "old.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := certs.SetFiles("/nonexistent/cert.pem", "/nonexistent/key.pem"); err == nil {
+		t.Error("expected an error for missing files")
+	}
+	if err := certs.SetFiles(writeCert(t, t.TempDir(), "new.example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := certs.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Subject.CommonName != "new.example.com" {
+		t.Errorf("expected the new certificate, got %s", leaf.Subject.CommonName)
+	}
+}
+
+func TestTLS_CertReloaderSetFilesServedOnHandshake(t *testing.T) {
+	certs, err := smtp.NewCertReloader(writeCert(t, t.TempDir(), "old.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := smtp.NewServer(&memBackend{})
+	srv.TLSConfig = certs.TLSConfig()
+	addr := startServer(t, srv)
+
+	if err := certs.SetFiles(writeCert(t, t.TempDir(), "new.example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, r, w := dialServer(t, addr)
+	send(t, w, "EHLO client.example.com")
+	readReply(t, r)
+	send(t, w, "STARTTLS")
+	assertCode(t, readLine(t, r), "220")
+
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if cn := tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName; cn != "new.example.com" {
+		t.Errorf("handshake served %s, want new.example.com", cn)
+	}
+}